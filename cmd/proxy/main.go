@@ -35,20 +35,260 @@ func main() {
 		zap.Int("metrics_port", cfg.MetricsPort),
 		zap.String("backend_address", cfg.BackendAddress))
 
+	negativeCachePolicy, err := cfg.NegativeCachePolicy()
+	if err != nil {
+		logger.Fatal("invalid negative cache policy", zap.Error(err))
+	}
+	retryCodes, err := cfg.RetryPolicyCodes()
+	if err != nil {
+		logger.Fatal("invalid retry policy", zap.Error(err))
+	}
+
 	// Initialize Collapser
 	collapserCfg := collapser.Config{
-		ResultCacheDuration: cfg.ResultCacheDuration,
-		BackendTimeout:      cfg.BackendTimeout,
-		CleanupInterval:     cfg.CleanupInterval,
+		ResultCacheDuration:  cfg.ResultCacheDuration,
+		BackendTimeout:       cfg.BackendTimeout,
+		CleanupInterval:      cfg.CleanupInterval,
+		Shards:               cfg.Shards,
+		MaxCacheEntries:      cfg.MaxCacheEntries,
+		MaxCacheBytes:        cfg.MaxCacheBytes,
+		StaleWhileRevalidate: cfg.StaleWhileRevalidate,
+		StaleIfError:         cfg.StaleIfError,
+		CancelAbandonedCalls: cfg.CancelAbandonedCalls,
+
+		NegativeCacheDuration: cfg.NegativeCacheDuration,
+		NegativeCachePolicy:   negativeCachePolicy,
+
+		Retry: collapser.RetryPolicy{
+			MaxAttempts:    cfg.RetryMaxAttempts,
+			Codes:          retryCodes,
+			InitialBackoff: cfg.RetryInitialBackoff,
+			MaxBackoff:     cfg.RetryMaxBackoff,
+			BudgetPercent:  cfg.RetryBudgetPercent,
+		},
+	}
+	var cache collapser.Cache[string, []byte]
+	switch cfg.CacheStore {
+	case "memory":
+		cache = collapser.NewMemoryCache(cfg.MaxCacheEntries, cfg.MaxCacheBytes, collapser.ByteSize)
+	case "disk":
+		if cache, err = collapser.NewDiskCache(cfg.CacheDir, cfg.MaxCacheEntries, cfg.MaxCacheBytes); err != nil {
+			logger.Fatal("failed to open disk cache", zap.Error(err))
+		}
+	default:
+		cache = collapser.NewShardedCache(cfg.Shards, cfg.MaxCacheEntries, cfg.MaxCacheBytes, collapser.ByteSize)
 	}
-	c := collapser.NewCollapser(collapserCfg)
+	opts := []collapser.Option{collapser.WithCache(cache)}
+	if len(cfg.Peers) > 0 {
+		logger.Info("Distributed collapsing enabled",
+			zap.String("self", cfg.SelfAddress),
+			zap.Strings("peers", cfg.Peers))
+		opts = append(opts, collapser.WithPeers(collapser.NewHashRing(cfg.SelfAddress, cfg.Peers, cfg.PeerReplicas)))
+	}
+	c := collapser.NewCollapser(collapserCfg, opts...)
 	if err := c.Start(); err != nil {
 		logger.Fatal("failed to start collapser", zap.Error(err))
 	}
 	defer c.Stop()
 
 	// Initialize Proxy Handler
-	proxyHandler := proxy.NewHandler(c, cfg.BackendAddress)
+	backendCfg := proxy.BackendConfig{
+		PoolSize:         cfg.BackendPoolSize,
+		KeepaliveTime:    cfg.BackendKeepaliveTime,
+		KeepaliveTimeout: cfg.BackendKeepaliveTimeout,
+		LoadBalancing:    proxy.LoadBalancing(cfg.BackendLBPolicy),
+		HealthCheck: proxy.HealthCheck{
+			Interval:           cfg.BackendHealthInterval,
+			Timeout:            cfg.BackendHealthTimeout,
+			Service:            cfg.BackendHealthService,
+			UnhealthyThreshold: cfg.BackendUnhealthyThreshold,
+			HealthyThreshold:   cfg.BackendHealthyThreshold,
+		},
+		OutlierDetection: proxy.OutlierDetection{
+			ConsecutiveErrors:  cfg.OutlierConsecutiveErrors,
+			LatencyFactor:      cfg.OutlierLatencyFactor,
+			Interval:           cfg.OutlierInterval,
+			BaseEjectionTime:   cfg.OutlierBaseEjectionTime,
+			MaxEjectionTime:    cfg.OutlierMaxEjectionTime,
+			MaxEjectionPercent: cfg.OutlierMaxEjectionPercent,
+		},
+	}
+	if cfg.BackendUseTLS {
+		backendCfg.TLS, err = proxy.NewClientTLS(proxy.TLSFiles{
+			CertFile: cfg.BackendTLSCertFile,
+			KeyFile:  cfg.BackendTLSKeyFile,
+			CAFile:   cfg.BackendTLSCAFile,
+		}, cfg.BackendTLSServerName)
+		if err != nil {
+			logger.Fatal("failed to load backend TLS files", zap.Error(err))
+		}
+	}
+	handlerOpts := []proxy.HandlerOption{
+		proxy.WithBackendConfig(backendCfg),
+		proxy.WithMetadataFilter(proxy.MetadataFilter{
+			Allow: cfg.MetadataAllow,
+			Deny:  cfg.MetadataDeny,
+		}),
+		proxy.WithKeyMetadata(cfg.KeyMetadata...),
+		proxy.WithCredentialMetadata(cfg.CredentialMetadata...),
+	}
+	if cfg.TLSCertFile != "" {
+		serverTLS, err := proxy.NewServerTLS(proxy.TLSFiles{
+			CertFile: cfg.TLSCertFile,
+			KeyFile:  cfg.TLSKeyFile,
+			CAFile:   cfg.TLSClientCAFile,
+		})
+		if err != nil {
+			logger.Fatal("failed to load listener TLS files", zap.Error(err))
+		}
+		logger.Info("TLS enabled on listener", zap.Bool("mtls", cfg.TLSClientCAFile != ""))
+		handlerOpts = append(handlerOpts, proxy.WithServerTLS(serverTLS))
+		if len(cfg.Peers) > 0 {
+			// Peers serve the same TLS listener, so forwarding must use it too
+			peerTLS, err := proxy.NewClientTLS(proxy.TLSFiles{
+				CertFile: cfg.TLSCertFile,
+				KeyFile:  cfg.TLSKeyFile,
+				CAFile:   cfg.PeerTLSCAFile,
+			}, cfg.PeerTLSServerName)
+			if err != nil {
+				logger.Fatal("failed to load peer TLS files", zap.Error(err))
+			}
+			handlerOpts = append(handlerOpts, proxy.WithPeerTLS(peerTLS))
+		}
+	}
+	methodCfg := &config.MethodConfig{}
+	if cfg.MethodConfigFile != "" {
+		if methodCfg, err = config.LoadMethodConfig(cfg.MethodConfigFile); err != nil {
+			logger.Fatal("failed to load method config", zap.Error(err))
+		}
+	}
+	masks := make(map[string]proxy.KeyMask)
+	var rules []proxy.PolicyRule
+	for _, rule := range methodCfg.Methods {
+		if len(rule.IgnoreFields) > 0 || len(rule.KeyFields) > 0 {
+			masks[rule.Name] = proxy.KeyMask{Ignore: rule.IgnoreFields, Only: rule.KeyFields}
+		}
+		mode := proxy.ModeCollapseCache
+		if rule.Mode != "" {
+			mode = proxy.Mode(rule.Mode)
+		}
+		rules = append(rules, proxy.PolicyRule{
+			Pattern: rule.Name,
+			Policy: proxy.MethodPolicy{
+				Mode:    mode,
+				TTL:     rule.TTL.Duration,
+				Timeout: rule.Timeout.Duration,
+			},
+		})
+	}
+	handlerOpts = append(handlerOpts,
+		proxy.WithKeyMasks(masks),
+		proxy.WithPolicies(rules, proxy.MethodPolicy{Mode: proxy.Mode(cfg.DefaultMode)}))
+	logger.Info("Method policies loaded",
+		zap.Int("rules", len(rules)),
+		zap.String("default_mode", cfg.DefaultMode))
+	switch {
+	case cfg.DescriptorSetFile != "":
+		descriptors, err := proxy.LoadDescriptorSet(cfg.DescriptorSetFile)
+		if err != nil {
+			logger.Fatal("failed to load descriptor set", zap.Error(err))
+		}
+		logger.Info("Loaded descriptor set", zap.Int("methods", descriptors.Len()))
+		handlerOpts = append(handlerOpts, proxy.WithDescriptors(descriptors))
+	case cfg.DescriptorReflection:
+		handlerOpts = append(handlerOpts, proxy.WithReflection())
+	}
+	if len(cfg.ServerStreamingMethods) > 0 {
+		streams := collapser.NewStreamGroup(collapser.StreamConfig{
+			MaxReplayMessages: cfg.StreamReplayLimit,
+		})
+		handlerOpts = append(handlerOpts, proxy.WithServerStreaming(streams, cfg.ServerStreamingMethods...))
+	}
+	if len(cfg.PassthroughMethods) > 0 {
+		handlerOpts = append(handlerOpts, proxy.WithPassthrough(cfg.PassthroughMethods...))
+	}
+	backendAddr := cfg.BackendAddress
+	if len(methodCfg.Clusters) == 0 && backendAddr == "" {
+		logger.Fatal("BACKEND_ADDRESS is required when METHOD_CONFIG_FILE defines no clusters")
+	}
+	if len(methodCfg.Clusters) > 0 {
+		clusters := make([]proxy.Cluster, 0, len(methodCfg.Clusters))
+		for _, cluster := range methodCfg.Clusters {
+			clusterCfg := backendCfg
+			clusterCfg.TLS = nil
+			if cluster.TLS != nil {
+				clusterCfg.TLS, err = proxy.NewClientTLS(proxy.TLSFiles{
+					CertFile: cluster.TLS.CertFile,
+					KeyFile:  cluster.TLS.KeyFile,
+					CAFile:   cluster.TLS.CAFile,
+				}, cluster.TLS.ServerName)
+				if err != nil {
+					logger.Fatal("failed to load cluster TLS files", zap.String("cluster", cluster.Name), zap.Error(err))
+				}
+			}
+			if cluster.LBPolicy != "" {
+				clusterCfg.LoadBalancing = proxy.LoadBalancing(cluster.LBPolicy)
+			}
+			if hc := cluster.HealthCheck; hc != nil {
+				clusterCfg.HealthCheck.Interval = hc.Interval.Duration
+				if hc.Timeout.Duration > 0 {
+					clusterCfg.HealthCheck.Timeout = hc.Timeout.Duration
+				}
+				if hc.Service != "" {
+					clusterCfg.HealthCheck.Service = hc.Service
+				}
+				if hc.UnhealthyThreshold > 0 {
+					clusterCfg.HealthCheck.UnhealthyThreshold = hc.UnhealthyThreshold
+				}
+				if hc.HealthyThreshold > 0 {
+					clusterCfg.HealthCheck.HealthyThreshold = hc.HealthyThreshold
+				}
+			}
+			if od := cluster.OutlierDetection; od != nil {
+				clusterCfg.OutlierDetection.ConsecutiveErrors = od.ConsecutiveErrors
+				clusterCfg.OutlierDetection.LatencyFactor = od.LatencyFactor
+				if od.Interval.Duration > 0 {
+					clusterCfg.OutlierDetection.Interval = od.Interval.Duration
+				}
+				if od.BaseEjectionTime.Duration > 0 {
+					clusterCfg.OutlierDetection.BaseEjectionTime = od.BaseEjectionTime.Duration
+				}
+				if od.MaxEjectionTime.Duration > 0 {
+					clusterCfg.OutlierDetection.MaxEjectionTime = od.MaxEjectionTime.Duration
+				}
+				if od.MaxEjectionPercent > 0 {
+					clusterCfg.OutlierDetection.MaxEjectionPercent = od.MaxEjectionPercent
+				}
+			}
+			var policy *proxy.MethodPolicy
+			if cluster.Mode != "" || cluster.TTL.Duration > 0 || cluster.Timeout.Duration > 0 {
+				// Without a mode, methods keep the one they would otherwise have
+				policy = &proxy.MethodPolicy{Mode: proxy.Mode(cluster.Mode), TTL: cluster.TTL.Duration, Timeout: cluster.Timeout.Duration}
+			}
+			clusters = append(clusters, proxy.Cluster{
+				Name:      cluster.Name,
+				Addresses: cluster.Addresses,
+				Backend:   clusterCfg,
+				Policy:    policy,
+			})
+		}
+		routes := make([]proxy.Route, 0, len(methodCfg.Routes))
+		for _, route := range methodCfg.Routes {
+			routes = append(routes, proxy.Route{Pattern: route.Match, Cluster: route.Cluster})
+		}
+		handlerOpts = append(handlerOpts, proxy.WithRoutes(clusters, routes, methodCfg.DefaultCluster))
+		// Clusters replace BACKEND_ADDRESS
+		backendAddr = ""
+		logger.Info("Backend clusters configured",
+			zap.Int("clusters", len(clusters)),
+			zap.Int("routes", len(routes)),
+			zap.String("default_cluster", methodCfg.DefaultCluster))
+	}
+	proxyHandler, err := proxy.NewHandler(c, backendAddr, handlerOpts...)
+	if err != nil {
+		logger.Fatal("failed to create proxy handler", zap.Error(err))
+	}
+	defer proxyHandler.Close()
 
 	// Start Metrics Server
 	go func() {
@@ -0,0 +1,80 @@
+package collapser
+
+import (
+	"time"
+)
+
+// Entry is a cached result together with its expiry.
+type Entry[V any] struct {
+	Value     V
+	Err       error
+	ExpiresAt time.Time
+}
+
+// Cache stores results between executions of the same key. The collapser
+// decides freshness from Entry.ExpiresAt and removes expired entries during
+// cleanup; implementations may additionally evict entries on their own.
+// Implementations must be safe for concurrent use.
+type Cache[K comparable, V any] interface {
+	Get(key K) (Entry[V], bool)
+	Set(key K, entry Entry[V])
+	Delete(key K)
+	// Range calls fn for each entry until fn returns false. fn must not call
+	// back into the cache.
+	Range(fn func(key K, entry Entry[V]) bool)
+}
+
+// expiringCache is implemented by caches that can drop expired entries more
+// cheaply than by reading every entry through Range.
+type expiringCache interface {
+	// DeleteExpired removes the entries that expired before t.
+	DeleteExpired(t time.Time)
+}
+
+// Option customises a Group or Collapser.
+type Option func(*options)
+
+type options struct {
+	cache  any // Cache[K, V]
+	sizeOf any // func(K, V) int64
+	peers  PeerPicker
+}
+
+// WithCache replaces the default sharded in-memory LRU result cache. Its key
+// and value types must match the Group it is passed to.
+func WithCache[K comparable, V any](cache Cache[K, V]) Option {
+	return func(o *options) {
+		o.cache = cache
+	}
+}
+
+// WithSizeFunc sets how the default cache measures entries against
+// Config.MaxCacheBytes. Without it only string and []byte keys and values
+// are counted.
+func WithSizeFunc[K comparable, V any](sizeOf func(K, V) int64) Option {
+	return func(o *options) {
+		o.sizeOf = sizeOf
+	}
+}
+
+// ByteSize measures a byte-oriented cache entry by its key and payload.
+func ByteSize(key string, data []byte) int64 {
+	return int64(len(key) + len(data))
+}
+
+// defaultSize counts the length of string and []byte keys and values and
+// treats anything else as zero-sized.
+func defaultSize[K comparable, V any](key K, val V) int64 {
+	return lenOf(key) + lenOf(val)
+}
+
+func lenOf(v any) int64 {
+	switch v := v.(type) {
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,299 @@
+package collapser
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/logger"
+	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const diskEntrySuffix = ".entry"
+
+// diskEvictTarget is the share of each limit a full DiskCache evicts down to,
+// so it does not scan its directory on every write once full.
+const diskEvictTarget = 0.9
+
+// DiskCache is a byte-oriented Cache that stores each entry as a file in a
+// directory, so cached results survive restarts and can exceed available
+// memory. Errors are persisted as
+// gRPC statuses; errors without a status are restored as codes.Unknown.
+//
+// Each file's modification time is set to the entry's expiry, so expired
+// entries are found without reading them. Once over its limits the cache
+// evicts the entries closest to expiry.
+type DiskCache struct {
+	dir        string
+	maxEntries int
+	maxBytes   int64
+
+	// mu guards the totals against the files in dir
+	mu      sync.Mutex
+	entries int
+	bytes   int64
+}
+
+type diskRecord struct {
+	Key       string
+	Data      []byte
+	HasErr    bool
+	Code      uint32
+	Message   string
+	ExpiresAt time.Time
+}
+
+// NewDiskCache creates a cache rooted at dir, creating it if necessary, and
+// bounded by the number of entry files and their total size. Zero limits
+// mean unlimited.
+func NewDiskCache(dir string, maxEntries int, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &DiskCache{dir: dir, maxEntries: maxEntries, maxBytes: maxBytes}
+	files, err := d.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		d.entries++
+		d.bytes += f.size
+	}
+	return d, nil
+}
+
+func (d *DiskCache) Get(key string) (Entry[[]byte], bool) {
+	rec, err := d.read(d.path(key))
+	if err != nil || rec.Key != key {
+		return Entry[[]byte]{}, false
+	}
+	return rec.entry(), true
+}
+
+// Set writes the entry and evicts entries until the cache is within its
+// limits. Entries larger than the whole byte budget are not stored.
+func (d *DiskCache) Set(key string, entry Entry[[]byte]) {
+	rec := diskRecord{Key: key, Data: entry.Value, ExpiresAt: entry.ExpiresAt}
+	if entry.Err != nil {
+		st := status.Convert(entry.Err)
+		rec.HasErr = true
+		rec.Code = uint32(st.Code())
+		rec.Message = st.Message()
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&rec); err != nil {
+		logger.Error("failed to encode disk cache entry", zap.Error(err))
+		return
+	}
+	size := int64(buf.Len())
+	if d.maxBytes > 0 && size > d.maxBytes {
+		d.Delete(key)
+		return
+	}
+
+	// Write to a temp file and rename so readers never see partial entries
+	tmp, err := os.CreateTemp(d.dir, "*.tmp")
+	if err != nil {
+		logger.Error("failed to create disk cache entry", zap.Error(err))
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		logger.Error("failed to write disk cache entry", zap.Error(err))
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		logger.Error("failed to write disk cache entry", zap.Error(err))
+		return
+	}
+	if err := os.Chtimes(tmp.Name(), time.Time{}, entry.ExpiresAt); err != nil {
+		logger.Error("failed to write disk cache entry", zap.Error(err))
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path := d.path(key)
+	old, statErr := os.Stat(path)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		logger.Error("failed to store disk cache entry", zap.Error(err))
+		return
+	}
+	if statErr == nil {
+		d.entries--
+		d.bytes -= old.Size()
+	}
+	d.entries++
+	d.bytes += size
+	if d.overLimits(1) {
+		d.evict()
+	}
+}
+
+func (d *DiskCache) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(d.path(key))
+}
+
+func (d *DiskCache) Range(fn func(key string, entry Entry[[]byte]) bool) {
+	files, err := d.files()
+	if err != nil {
+		logger.Error("failed to list disk cache", zap.Error(err))
+		return
+	}
+	for _, f := range files {
+		rec, err := d.read(f.path)
+		if err != nil {
+			continue
+		}
+		if !fn(rec.Key, rec.entry()) {
+			return
+		}
+	}
+}
+
+// DeleteExpired removes the entries that expired before t, telling them
+// apart by modification time alone.
+func (d *DiskCache) DeleteExpired(t time.Time) {
+	files, err := d.files()
+	if err != nil {
+		logger.Error("failed to list disk cache", zap.Error(err))
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, f := range files {
+		if f.expiresAt.Before(t) {
+			d.remove(f.path)
+		}
+	}
+}
+
+// Len returns the number of cached entries.
+func (d *DiskCache) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.entries
+}
+
+// Bytes returns the total size of the entry files.
+func (d *DiskCache) Bytes() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.bytes
+}
+
+// overLimits reports whether the cache exceeds share of either limit. The
+// caller must hold d.mu.
+func (d *DiskCache) overLimits(share float64) bool {
+	return (d.maxEntries > 0 && float64(d.entries) > share*float64(d.maxEntries)) ||
+		(d.maxBytes > 0 && float64(d.bytes) > share*float64(d.maxBytes))
+}
+
+// evict removes the entries closest to expiry until the cache is back below
+// diskEvictTarget of its limits. The caller must hold d.mu.
+func (d *DiskCache) evict() {
+	files, err := d.files()
+	if err != nil {
+		logger.Error("failed to list disk cache", zap.Error(err))
+		return
+	}
+	slices.SortFunc(files, func(a, b diskFile) int {
+		return a.expiresAt.Compare(b.expiresAt)
+	})
+	for _, f := range files {
+		if !d.overLimits(diskEvictTarget) {
+			return
+		}
+		reason := evictReasonBytes
+		if d.maxEntries > 0 && float64(d.entries) > diskEvictTarget*float64(d.maxEntries) {
+			reason = evictReasonEntries
+		}
+		if d.remove(f.path) {
+			monitoring.CacheEvictionsTotal.WithLabelValues(reason).Inc()
+		}
+	}
+}
+
+// remove deletes the entry file at path and reports whether there was one.
+// The caller must hold d.mu.
+func (d *DiskCache) remove(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if err := os.Remove(path); err != nil {
+		return false
+	}
+	d.entries--
+	d.bytes -= info.Size()
+	return true
+}
+
+// diskFile is an entry file as listed, without its contents.
+type diskFile struct {
+	path      string
+	size      int64
+	expiresAt time.Time
+}
+
+func (d *DiskCache) files() ([]diskFile, error) {
+	dirEntries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]diskFile, 0, len(dirEntries))
+	for _, e := range dirEntries {
+		if !strings.HasSuffix(e.Name(), diskEntrySuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, diskFile{
+			path:      filepath.Join(d.dir, e.Name()),
+			size:      info.Size(),
+			expiresAt: info.ModTime(),
+		})
+	}
+	return files, nil
+}
+
+func (d *DiskCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(hash[:])+diskEntrySuffix)
+}
+
+func (d *DiskCache) read(path string) (*diskRecord, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec diskRecord
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (r *diskRecord) entry() Entry[[]byte] {
+	e := Entry[[]byte]{Value: r.Data, ExpiresAt: r.ExpiresAt}
+	if r.HasErr {
+		e.Err = status.Error(codes.Code(r.Code), r.Message)
+	}
+	return e
+}
@@ -0,0 +1,220 @@
+package collapser
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
+)
+
+// Eviction reasons reported on monitoring.CacheEvictionsTotal.
+const (
+	evictReasonEntries = "max_entries"
+	evictReasonBytes   = "max_bytes"
+)
+
+// accessBufferSize bounds how many cache hits can be queued for LRU
+// promotion between writes. Hits beyond it are not recorded.
+const accessBufferSize = 256
+
+// MemoryCache is an in-memory LRU bounded by entry count and total bytes of
+// keys and data.
+//
+// Reads are lock-free: hits are looked up in a sync.Map and queued for LRU
+// promotion, which is applied by the next write under the lock. When reads
+// outpace writes some promotions are dropped, so eviction order is an
+// approximation of LRU under heavy read load.
+type MemoryCache[K comparable, V any] struct {
+	index    sync.Map // K -> *memoryEntry[K, V]
+	accesses chan *memoryEntry[K, V]
+	sizeOf   func(K, V) int64
+
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	ll         *list.List
+	bytes      int64
+
+	// budget, when set, tracks the totals of every cache sharing a budget
+	budget *cacheBudget
+}
+
+// cacheBudget counts the entries and bytes of several MemoryCaches, so limits
+// can be enforced across them.
+type cacheBudget struct {
+	entries atomic.Int64
+	bytes   atomic.Int64
+}
+
+func (b *cacheBudget) add(entries, bytes int64) {
+	if b != nil {
+		b.entries.Add(entries)
+		b.bytes.Add(bytes)
+	}
+}
+
+// memoryEntry is immutable once published in the index except for elem,
+// which is guarded by MemoryCache.mu and cleared on removal.
+type memoryEntry[K comparable, V any] struct {
+	key   K
+	size  int64
+	entry Entry[V]
+	elem  *list.Element
+}
+
+// NewMemoryCache creates an LRU cache. Zero limits mean unlimited. sizeOf
+// measures entries against maxBytes; nil counts string and []byte keys and
+// values only (see ByteSize for byte-oriented caches).
+func NewMemoryCache[K comparable, V any](maxEntries int, maxBytes int64, sizeOf func(K, V) int64) *MemoryCache[K, V] {
+	if sizeOf == nil {
+		sizeOf = defaultSize[K, V]
+	}
+	return &MemoryCache[K, V]{
+		accesses:   make(chan *memoryEntry[K, V], accessBufferSize),
+		sizeOf:     sizeOf,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+	}
+}
+
+// Get returns the entry for key and marks it as recently used.
+func (m *MemoryCache[K, V]) Get(key K) (Entry[V], bool) {
+	v, ok := m.index.Load(key)
+	if !ok {
+		return Entry[V]{}, false
+	}
+	e := v.(*memoryEntry[K, V])
+	select {
+	case m.accesses <- e:
+	default:
+	}
+	return e.entry, true
+}
+
+// Set inserts or replaces the entry for key and evicts least recently used
+// entries until the cache is back within its limits. Entries larger than the
+// whole byte budget are not stored.
+func (m *MemoryCache[K, V]) Set(key K, entry Entry[V]) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applyAccesses()
+
+	size := m.sizeOf(key, entry.Value)
+	if m.maxBytes > 0 && size > m.maxBytes {
+		m.delete(key)
+		return
+	}
+
+	e := &memoryEntry[K, V]{key: key, size: size, entry: entry}
+	if v, ok := m.index.Load(key); ok {
+		old := v.(*memoryEntry[K, V])
+		m.bytes += size - old.size
+		m.budget.add(0, size-old.size)
+		monitoring.CachedBytes.Add(float64(size - old.size))
+		e.elem = old.elem
+		e.elem.Value = e
+		old.elem = nil
+		m.ll.MoveToFront(e.elem)
+	} else {
+		e.elem = m.ll.PushFront(e)
+		m.bytes += size
+		m.budget.add(1, size)
+		monitoring.CachedResults.Inc()
+		monitoring.CachedBytes.Add(float64(size))
+	}
+	m.index.Store(key, e)
+
+	for m.maxEntries > 0 && m.ll.Len() > m.maxEntries {
+		m.removeOldest(evictReasonEntries)
+	}
+	for m.maxBytes > 0 && m.bytes > m.maxBytes {
+		m.removeOldest(evictReasonBytes)
+	}
+}
+
+// Delete drops the entry for key, if present.
+func (m *MemoryCache[K, V]) Delete(key K) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delete(key)
+}
+
+// Range calls fn for each entry from most to least recently used.
+func (m *MemoryCache[K, V]) Range(fn func(key K, entry Entry[V]) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applyAccesses()
+
+	for elem := m.ll.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*memoryEntry[K, V])
+		if !fn(e.key, e.entry) {
+			return
+		}
+	}
+}
+
+// Len returns the number of cached entries.
+func (m *MemoryCache[K, V]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ll.Len()
+}
+
+// Bytes returns the total size of cached keys and data.
+func (m *MemoryCache[K, V]) Bytes() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes
+}
+
+// applyAccesses promotes entries read since the last write. Entries removed
+// or replaced in the meantime have no element and are skipped.
+func (m *MemoryCache[K, V]) applyAccesses() {
+	for {
+		select {
+		case e := <-m.accesses:
+			if e.elem != nil {
+				m.ll.MoveToFront(e.elem)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (m *MemoryCache[K, V]) delete(key K) {
+	if v, ok := m.index.Load(key); ok {
+		m.remove(v.(*memoryEntry[K, V]))
+	}
+}
+
+// evictOldest drops the least recently used entry and reports whether there
+// was one.
+func (m *MemoryCache[K, V]) evictOldest(reason string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applyAccesses()
+	return m.removeOldest(reason)
+}
+
+func (m *MemoryCache[K, V]) removeOldest(reason string) bool {
+	elem := m.ll.Back()
+	if elem == nil {
+		return false
+	}
+	m.remove(elem.Value.(*memoryEntry[K, V]))
+	monitoring.CacheEvictionsTotal.WithLabelValues(reason).Inc()
+	return true
+}
+
+func (m *MemoryCache[K, V]) remove(e *memoryEntry[K, V]) {
+	m.ll.Remove(e.elem)
+	e.elem = nil
+	m.index.Delete(e.key)
+	m.bytes -= e.size
+	m.budget.add(-1, -e.size)
+	monitoring.CachedResults.Dec()
+	monitoring.CachedBytes.Sub(float64(e.size))
+}
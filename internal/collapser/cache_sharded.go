@@ -0,0 +1,121 @@
+package collapser
+
+import (
+	"hash/maphash"
+	"sync/atomic"
+)
+
+// ShardedCache spreads keys over several MemoryCache shards so unrelated
+// keys do not contend on a single lock. Limits apply to the cache as a
+// whole: once over them, shards give up their least recently used entry in
+// turn, so eviction order is only LRU within a shard.
+type ShardedCache[K comparable, V any] struct {
+	seed       maphash.Seed
+	shards     []*MemoryCache[K, V]
+	maxEntries int
+	maxBytes   int64
+	budget     cacheBudget
+	next       atomic.Uint64
+}
+
+// NewShardedCache creates a cache with the given number of shards. Zero
+// limits mean unlimited; sizeOf is as for NewMemoryCache.
+func NewShardedCache[K comparable, V any](shards, maxEntries int, maxBytes int64, sizeOf func(K, V) int64) *ShardedCache[K, V] {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &ShardedCache[K, V]{
+		seed:       maphash.MakeSeed(),
+		shards:     make([]*MemoryCache[K, V], shards),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+	for i := range s.shards {
+		// Each shard may use the whole budget, so no entry that fits the
+		// cache is too large for its shard
+		s.shards[i] = NewMemoryCache(maxEntries, maxBytes, sizeOf)
+		s.shards[i].budget = &s.budget
+	}
+	return s
+}
+
+func (s *ShardedCache[K, V]) Get(key K) (Entry[V], bool) {
+	return s.shard(key).Get(key)
+}
+
+// Set stores the entry in its shard, then evicts entries across shards
+// until the cache is back within its limits. The entry's own shard is only
+// evicted from once the others are empty, so the entry is never evicted first.
+func (s *ShardedCache[K, V]) Set(key K, entry Entry[V]) {
+	own := s.shard(key)
+	own.Set(key, entry)
+
+	// Shards are locked one at a time, so concurrent writers never wait on
+	// each other's shard while holding their own
+	for empty := 0; ; {
+		reason := s.overBudget()
+		if reason == "" {
+			return
+		}
+		if empty >= len(s.shards)-1 {
+			if !own.evictOldest(reason) {
+				return
+			}
+			continue
+		}
+		shard := s.shards[s.next.Add(1)%uint64(len(s.shards))]
+		if shard == own {
+			continue
+		}
+		if shard.evictOldest(reason) {
+			empty = 0
+		} else {
+			empty++
+		}
+	}
+}
+
+func (s *ShardedCache[K, V]) Delete(key K) {
+	s.shard(key).Delete(key)
+}
+
+func (s *ShardedCache[K, V]) Range(fn func(key K, entry Entry[V]) bool) {
+	for _, shard := range s.shards {
+		stopped := false
+		shard.Range(func(key K, entry Entry[V]) bool {
+			if !fn(key, entry) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// Len returns the number of cached entries.
+func (s *ShardedCache[K, V]) Len() int {
+	return int(s.budget.entries.Load())
+}
+
+// Bytes returns the total size of cached keys and data.
+func (s *ShardedCache[K, V]) Bytes() int64 {
+	return s.budget.bytes.Load()
+}
+
+// overBudget returns the limit the cache exceeds, or "" when within both.
+func (s *ShardedCache[K, V]) overBudget() string {
+	switch {
+	case s.maxEntries > 0 && s.budget.entries.Load() > int64(s.maxEntries):
+		return evictReasonEntries
+	case s.maxBytes > 0 && s.budget.bytes.Load() > s.maxBytes:
+		return evictReasonBytes
+	}
+	return ""
+}
+
+func (s *ShardedCache[K, V]) shard(key K) *MemoryCache[K, V] {
+	return s.shards[maphash.Comparable(s.seed, key)%uint64(len(s.shards))]
+}
@@ -3,13 +3,10 @@ package collapser
 import (
 	"context"
 	"fmt"
-	"sync"
-	"sync/atomic"
 	"time"
 
-	"github.com/VarunGitGood/collapser-grpc/internal/logger"
-	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
-	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type State int32
@@ -23,196 +20,119 @@ type Config struct {
 	ResultCacheDuration time.Duration
 	BackendTimeout      time.Duration
 	CleanupInterval     time.Duration
-}
-
-type Collapser struct {
-	mu     sync.RWMutex
-	config Config
-
-	inflight map[string]*inflightCall
-	cache    map[string]*cachedResult
 
-	stopCh chan struct{}
-	wg     sync.WaitGroup
+	// Shards is the number of independently locked segments the inflight
+	// map and default cache are split into. Zero uses DefaultShards.
+	Shards int
+
+	// MaxCacheEntries and MaxCacheBytes bound the result cache. When either
+	// limit is exceeded the least recently used results are evicted. Zero
+	// means unlimited.
+	MaxCacheEntries int
+	MaxCacheBytes   int64
+
+	// NegativeCacheDuration is how long backend errors are cached.
+	// NegativeCachePolicy overrides it per gRPC status code; a zero duration
+	// means errors with that code are never cached.
+	NegativeCacheDuration time.Duration
+	NegativeCachePolicy   map[codes.Code]time.Duration
+
+	// StaleWhileRevalidate is how long past expiry a successful result may
+	// still be served while a background leader refreshes the key.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is how long past expiry a successful result may be served
+	// to the leader and its waiters in place of a backend error.
+	StaleIfError time.Duration
+
+	// CancelAbandonedCalls reference-counts the callers waiting on each
+	// backend call and cancels it, without caching, once all of them have
+	// gone away. By default backend calls always run to completion.
+	CancelAbandonedCalls bool
+
+	// Retry retries failed executions before their result is shared. Calls
+	// forwarded to a peer are retried by that peer.
+	Retry RetryPolicy
 }
 
-type inflightCall struct {
-	state   atomic.Int32
-	waiters []chan result
-	res     *result
-	mu      sync.Mutex
-}
+// Stale response reasons reported on monitoring.StaleResponsesTotal.
+const (
+	staleReasonRevalidate = "revalidate"
+	staleReasonError      = "error"
+)
 
-type cachedResult struct {
-	data      []byte
-	err       error
-	expiresAt time.Time
+// PanicError is returned to the leader and every waiter when the fn passed
+// to Execute panics. It maps to a gRPC Internal status. Panics are never
+// cached.
+type PanicError struct {
+	Value any
+	Stack []byte
 }
 
-type result struct {
-	data []byte
-	err  error
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("collapsed call panicked: %v", e.Value)
 }
 
-func NewCollapser(cfg Config) *Collapser {
-	return &Collapser{
-		config:   cfg,
-		inflight: make(map[string]*inflightCall),
-		cache:    make(map[string]*cachedResult),
-		stopCh:   make(chan struct{}),
-	}
+// GRPCStatus lets gRPC servers report the panic as codes.Internal without
+// leaking the panic value to clients.
+func (e *PanicError) GRPCStatus() *status.Status {
+	return status.New(codes.Internal, "collapsed call panicked")
 }
 
-func (c *Collapser) Start() error {
-	c.wg.Add(1)
-	go c.cleanupLoop()
-	return nil
+// Outcome describes how a result returned by ExecuteWithOutcome was produced.
+type Outcome struct {
+	// Stale is set when expired cached data was served, either while the key
+	// was being revalidated or in place of a backend error.
+	Stale bool
+	// Cached is set when the result came from the result cache.
+	Cached bool
+	// Shared is set when the result of one execution went to several callers.
+	Shared bool
 }
 
-func (c *Collapser) Stop() error {
-	close(c.stopCh)
-	c.wg.Wait()
+// Policy adjusts how a single call is collapsed and cached. The zero value
+// follows the Group's Config.
+type Policy struct {
+	// NoCollapse executes the call on its own instead of joining an
+	// identical inflight call. Its result may still be cached.
+	NoCollapse bool
+	// NoCache neither serves nor stores cached results for the call.
+	NoCache bool
+
+	// ResultCacheDuration and BackendTimeout override the Config values
+	// when positive.
+	ResultCacheDuration time.Duration
+	BackendTimeout      time.Duration
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	// NegativeCachePolicy overrides, per gRPC status code, how long errors
+	// are cached; codes it does not list follow the Config.
+	NegativeCachePolicy map[codes.Code]time.Duration
+}
 
-	for key, call := range c.inflight {
-		c.notifyWaiters(call, result{err: fmt.Errorf("shutting down")})
-		delete(c.inflight, key)
-	}
+// DefaultShards is used when Config.Shards is not set.
+const DefaultShards = 32
 
-	return nil
+// Collapser is the byte-oriented Group used by the proxy: keys are request
+// hashes and values are raw response payloads.
+type Collapser struct {
+	*Group[string, []byte]
 }
 
-func (c *Collapser) Execute(ctx context.Context, key string, fn func(context.Context) ([]byte, error)) ([]byte, error) {
-	monitoring.RequestsTotal.Inc()
-
-	if err := ctx.Err(); err != nil {
-		return nil, err
-	}
-
-	// 1. Check result cache
-	c.mu.RLock()
-	if cached, exists := c.cache[key]; exists {
-		if time.Now().Before(cached.expiresAt) {
-			c.mu.RUnlock()
-			monitoring.CacheHitsTotal.Inc()
-			return cached.data, cached.err
-		}
-	}
-	c.mu.RUnlock()
-
-	// 2. Check inflight
-	c.mu.Lock()
-	if call, exists := c.inflight[key]; exists {
-		monitoring.CollapsedRequestsTotal.Inc()
-		waiterCh := make(chan result, 1)
-
-		call.mu.Lock()
-		// Double check if it just finished
-		if State(call.state.Load()) == StateDone {
-			res := *call.res
-			call.mu.Unlock()
-			c.mu.Unlock()
-			return res.data, res.err
-		}
-		call.waiters = append(call.waiters, waiterCh)
-		call.mu.Unlock()
-		c.mu.Unlock()
-
-		select {
-		case res := <-waiterCh:
-			return res.data, res.err
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
-	}
-
-	// 3. Become leader
-	call := &inflightCall{
-		waiters: make([]chan result, 0),
-	}
-	call.state.Store(int32(StateExecuting))
-	c.inflight[key] = call
-	monitoring.InflightRequests.Inc()
-	monitoring.BackendCallsTotal.Inc()
-	c.mu.Unlock()
-
-	// Detached context for backend
-	backendCtx, cancel := context.WithTimeout(context.Background(), c.config.BackendTimeout)
-	defer cancel()
-
-	start := time.Now()
-	data, err := fn(backendCtx)
-	monitoring.BackendLatency.Observe(time.Since(start).Seconds())
-
-	res := result{data: data, err: err}
-
-	// 4. Update inflight state and notify
-	call.mu.Lock()
-	call.res = &res
-	call.state.Store(int32(StateDone))
-	waiters := call.waiters
-	call.waiters = nil
-	call.mu.Unlock()
-
-	c.notifyWaiters(call, res, waiters...)
-
-	// 5. Cache result and move from inflight to cache
-	c.mu.Lock()
-	delete(c.inflight, key)
-	monitoring.InflightRequests.Dec()
-	c.cache[key] = &cachedResult{
-		data:      data,
-		err:       err,
-		expiresAt: time.Now().Add(c.config.ResultCacheDuration),
-	}
-	monitoring.CachedResults.Inc()
-	c.mu.Unlock()
-
-	return data, err
+func NewCollapser(cfg Config, opts ...Option) *Collapser {
+	return &Collapser{Group: NewGroup[string, []byte](cfg, opts...)}
 }
 
-func (c *Collapser) notifyWaiters(call *inflightCall, res result, waiters ...chan result) {
-	for _, ch := range waiters {
-		func(waiterCh chan result) {
-			defer func() {
-				if r := recover(); r != nil {
-					logger.Error("panic notifying waiter", zap.Any("panic", r))
-				}
-			}()
-			select {
-			case waiterCh <- res:
-			default:
-			}
-			close(waiterCh)
-		}(ch)
-	}
+func (c *Collapser) Execute(ctx context.Context, key string, fn func(context.Context) ([]byte, error)) ([]byte, error) {
+	return c.Do(ctx, key, fn)
 }
 
-func (c *Collapser) cleanupLoop() {
-	defer c.wg.Done()
-	ticker := time.NewTicker(c.config.CleanupInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			c.cleanup()
-		case <-c.stopCh:
-			return
-		}
-	}
+// ExecuteWithOutcome is like Execute but also reports how the result was
+// produced, so callers can tell clients when they received stale data.
+func (c *Collapser) ExecuteWithOutcome(ctx context.Context, key string, fn func(context.Context) ([]byte, error)) ([]byte, Outcome, error) {
+	return c.DoOutcome(ctx, key, fn)
 }
 
-func (c *Collapser) cleanup() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	now := time.Now()
-	for key, cached := range c.cache {
-		if now.After(cached.expiresAt) {
-			delete(c.cache, key)
-			monitoring.CachedResults.Dec()
-		}
-	}
+// ExecuteWithPolicy is like ExecuteWithOutcome but applies policy to the call.
+func (c *Collapser) ExecuteWithPolicy(ctx context.Context, key string, policy Policy, fn func(context.Context) ([]byte, error)) ([]byte, Outcome, error) {
+	return c.DoPolicy(ctx, key, policy, fn)
 }
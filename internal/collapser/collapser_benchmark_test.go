@@ -96,3 +96,38 @@ func BenchmarkBackend_Direct(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkCollapser_ManyDistinctKeys benchmarks a parallel mix of misses and
+// cache hits over a large key space, comparing a single lock against sharding.
+func BenchmarkCollapser_ManyDistinctKeys(b *testing.B) {
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	fn := func(ctx context.Context) ([]byte, error) {
+		return []byte("data"), nil
+	}
+
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := NewCollapser(Config{
+				ResultCacheDuration: 100 * time.Millisecond,
+				BackendTimeout:      10 * time.Second,
+				CleanupInterval:     1 * time.Second,
+				Shards:              shards,
+			})
+			c.Start()
+			defer c.Stop()
+
+			var i int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := keys[atomic.AddInt64(&i, 1)%int64(len(keys))]
+					_, _ = c.Execute(context.Background(), key, fn)
+				}
+			})
+		})
+	}
+}
@@ -3,35 +3,183 @@ package collapser
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// cacheImpls lists every built-in Cache so behaviour tests run against each.
+var cacheImpls = []struct {
+	name     string
+	newCache func(t *testing.T, cfg Config) Cache[string, []byte]
+}{
+	{"memory", func(t *testing.T, cfg Config) Cache[string, []byte] {
+		return NewMemoryCache(cfg.MaxCacheEntries, cfg.MaxCacheBytes, ByteSize)
+	}},
+	{"sharded", func(t *testing.T, cfg Config) Cache[string, []byte] {
+		return NewShardedCache(8, cfg.MaxCacheEntries, cfg.MaxCacheBytes, ByteSize)
+	}},
+	{"disk", func(t *testing.T, cfg Config) Cache[string, []byte] {
+		cache, err := NewDiskCache(t.TempDir(), cfg.MaxCacheEntries, cfg.MaxCacheBytes)
+		if err != nil {
+			t.Fatalf("failed to create disk cache: %v", err)
+		}
+		return cache
+	}},
+}
+
+// forEachCache runs test against a started Collapser backed by each Cache.
+func forEachCache(t *testing.T, cfg Config, test func(t *testing.T, c *Collapser)) {
+	for _, impl := range cacheImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			c := NewCollapser(cfg, WithCache(impl.newCache(t, cfg)))
+			c.Start()
+			defer c.Stop()
+			test(t, c)
+		})
+	}
+}
+
 func TestCollapser_BasicCollapse(t *testing.T) {
-	c := NewCollapser(Config{
+	forEachCache(t, Config{
 		ResultCacheDuration: 100 * time.Millisecond,
 		BackendTimeout:      10 * time.Second,
 		CleanupInterval:     1 * time.Second,
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			time.Sleep(50 * time.Millisecond)
+			return []byte("result"), nil
+		}
+
+		// Send 100 concurrent requests
+		var wg sync.WaitGroup
+		wg.Add(100)
+
+		for i := 0; i < 100; i++ {
+			go func() {
+				defer wg.Done()
+				data, err := c.Execute(context.Background(), "key1", fn)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if string(data) != "result" {
+					t.Errorf("expected 'result', got %s", data)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if backendCalls != 1 {
+			t.Errorf("expected 1 backend call, got %d", backendCalls)
+		}
 	})
-	c.Start()
-	defer c.Stop()
+}
 
-	var backendCalls int64
-	fn := func(ctx context.Context) ([]byte, error) {
-		atomic.AddInt64(&backendCalls, 1)
-		time.Sleep(50 * time.Millisecond)
-		return []byte("result"), nil
-	}
+func TestCollapser_CacheHit(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration: 200 * time.Millisecond,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     1 * time.Second,
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			return []byte("cached"), nil
+		}
 
-	// Send 100 concurrent requests
-	var wg sync.WaitGroup
-	wg.Add(100)
+		// First call
+		_, _ = c.Execute(context.Background(), "key1", fn)
 
-	for i := 0; i < 100; i++ {
+		// Wait for execution to complete
+		time.Sleep(10 * time.Millisecond)
+
+		// Second call (should hit cache)
+		data, err := c.Execute(context.Background(), "key1", fn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(data) != "cached" {
+			t.Errorf("expected 'cached', got %s", data)
+		}
+
+		if backendCalls != 1 {
+			t.Errorf("expected 1 backend call (cache hit), got %d", backendCalls)
+		}
+	})
+}
+
+func TestCollapser_CacheExpiry(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration: 50 * time.Millisecond,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     10 * time.Millisecond,
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			return []byte("result"), nil
+		}
+
+		// First call
+		c.Execute(context.Background(), "key1", fn)
+
+		// Wait for cache to expire
+		time.Sleep(100 * time.Millisecond)
+
+		// Second call (cache expired, should execute again)
+		c.Execute(context.Background(), "key1", fn)
+
+		if backendCalls != 2 {
+			t.Errorf("expected 2 backend calls (cache expired), got %d", backendCalls)
+		}
+	})
+}
+
+func TestCollapser_ClientCancellation(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration: 100 * time.Millisecond,
+		BackendTimeout:      10 * time.Second,
+		CleanupInterval:     1 * time.Second,
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls int64
+		var backendCompleted int64
+
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			time.Sleep(100 * time.Millisecond)
+			atomic.AddInt64(&backendCompleted, 1)
+			return []byte("result"), nil
+		}
+
+		// Client 1: cancels immediately
+		ctx1, cancel1 := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			_, err := c.Execute(ctx1, "key1", fn)
+			if err != context.Canceled {
+				t.Errorf("expected context.Canceled, got %v", err)
+			}
+		}()
+
+		// Cancel immediately
+		cancel1()
+
+		// Client 2: waits for result
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(10 * time.Millisecond) // Start after client1
 			data, err := c.Execute(context.Background(), "key1", fn)
 			if err != nil {
 				t.Errorf("unexpected error: %v", err)
@@ -40,205 +188,596 @@ func TestCollapser_BasicCollapse(t *testing.T) {
 				t.Errorf("expected 'result', got %s", data)
 			}
 		}()
-	}
 
-	wg.Wait()
+		wg.Wait()
 
-	if backendCalls != 1 {
-		t.Errorf("expected 1 backend call, got %d", backendCalls)
-	}
+		// Backend should complete despite client1 cancellation
+		if backendCompleted != 1 {
+			t.Errorf("backend should complete, got %d completions", backendCompleted)
+		}
+	})
 }
 
-func TestCollapser_CacheHit(t *testing.T) {
-	c := NewCollapser(Config{
-		ResultCacheDuration: 200 * time.Millisecond,
-		BackendTimeout:      5 * time.Second,
+func TestCollapser_ErrorPropagation(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration: 100 * time.Millisecond,
+		BackendTimeout:      10 * time.Second,
+		CleanupInterval:     1 * time.Second,
+	}, func(t *testing.T, c *Collapser) {
+		expectedErr := errors.New("backend error")
+		fn := func(ctx context.Context) ([]byte, error) {
+			return nil, expectedErr
+		}
+
+		// Multiple requests should all get the same error
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := c.Execute(context.Background(), "key1", fn)
+				if err != expectedErr {
+					t.Errorf("expected backend error, got %v", err)
+				}
+			}()
+		}
+
+		wg.Wait()
+	})
+}
+
+func TestCollapser_MultipleKeys(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration: 100 * time.Millisecond,
+		BackendTimeout:      10 * time.Second,
 		CleanupInterval:     1 * time.Second,
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			time.Sleep(50 * time.Millisecond)
+			return []byte("result"), nil
+		}
+
+		var wg sync.WaitGroup
+
+		// 50 requests for key1
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.Execute(context.Background(), "key1", fn)
+			}()
+		}
+
+		// 50 requests for key2
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.Execute(context.Background(), "key2", fn)
+			}()
+		}
+
+		wg.Wait()
+
+		// Should have 2 backend calls (one per key)
+		if backendCalls != 2 {
+			t.Errorf("expected 2 backend calls, got %d", backendCalls)
+		}
 	})
-	c.Start()
-	defer c.Stop()
+}
 
-	var backendCalls int64
-	fn := func(ctx context.Context) ([]byte, error) {
-		atomic.AddInt64(&backendCalls, 1)
-		return []byte("cached"), nil
+func TestMemoryCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewMemoryCache(2, 0, ByteSize)
+	entry := Entry[[]byte]{Value: []byte("result"), ExpiresAt: time.Now().Add(time.Hour)}
+
+	cache.Set("key1", entry)
+	cache.Set("key2", entry)
+	// Touch key1 so key2 becomes the eviction candidate
+	cache.Get("key1")
+	cache.Set("key3", entry)
+
+	if _, ok := cache.Get("key1"); !ok {
+		t.Errorf("expected key1 to stay cached")
+	}
+	if _, ok := cache.Get("key2"); ok {
+		t.Errorf("expected key2 to be evicted")
+	}
+	if cache.Len() != 2 {
+		t.Errorf("expected 2 cached entries, got %d", cache.Len())
 	}
+}
+
+func TestMemoryCache_ByteBudget(t *testing.T) {
+	cache := NewMemoryCache(0, 64, ByteSize)
+	entry := Entry[[]byte]{Value: make([]byte, 20), ExpiresAt: time.Now().Add(time.Hour)}
 
-	// First call
-	_, _ = c.Execute(context.Background(), "key1", fn)
+	for i := 0; i < 10; i++ {
+		cache.Set(string(rune('a'+i)), entry)
+	}
 
-	// Wait for execution to complete
-	time.Sleep(10 * time.Millisecond)
+	if cache.Bytes() > 64 {
+		t.Errorf("cache exceeds byte budget: %d bytes", cache.Bytes())
+	}
+	if cache.Len() != 3 {
+		t.Errorf("expected 3 cached entries, got %d", cache.Len())
+	}
+
+	// Entries larger than the whole budget are never stored
+	cache.Set("huge", Entry[[]byte]{Value: make([]byte, 100)})
+	if _, ok := cache.Get("huge"); ok {
+		t.Errorf("expected oversized entry not to be cached")
+	}
+}
+
+func TestDiskCache_Limits(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir(), 10, 0)
+	if err != nil {
+		t.Fatalf("failed to create disk cache: %v", err)
+	}
+	now := time.Now()
+	for i := 0; i < 11; i++ {
+		// Later keys expire later
+		cache.Set(fmt.Sprintf("key%d", i), Entry[[]byte]{Value: []byte("result"), ExpiresAt: now.Add(time.Duration(i+1) * time.Minute)})
+	}
+	if n := cache.Len(); n != 9 {
+		t.Errorf("expected eviction down to 9 entries, got %d", n)
+	}
+	for _, key := range []string{"key0", "key1"} {
+		if _, ok := cache.Get(key); ok {
+			t.Errorf("expected %s, closest to expiry, to be evicted", key)
+		}
+	}
+	if _, ok := cache.Get("key10"); !ok {
+		t.Errorf("expected the latest entry to stay cached")
+	}
 
-	// Second call (should hit cache)
-	data, err := c.Execute(context.Background(), "key1", fn)
+	// Totals survive a restart
+	reopened, err := NewDiskCache(cache.dir, 10, 0)
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatalf("failed to reopen disk cache: %v", err)
 	}
-	if string(data) != "cached" {
-		t.Errorf("expected 'cached', got %s", data)
+	if reopened.Len() != cache.Len() || reopened.Bytes() != cache.Bytes() {
+		t.Errorf("expected %d entries and %d bytes after reopening, got %d and %d",
+			cache.Len(), cache.Bytes(), reopened.Len(), reopened.Bytes())
 	}
 
-	if backendCalls != 1 {
-		t.Errorf("expected 1 backend call (cache hit), got %d", backendCalls)
+	cache, err = NewDiskCache(t.TempDir(), 0, 100)
+	if err != nil {
+		t.Fatalf("failed to create disk cache: %v", err)
+	}
+	cache.Set("huge", Entry[[]byte]{Value: make([]byte, 200), ExpiresAt: now.Add(time.Hour)})
+	if _, ok := cache.Get("huge"); ok || cache.Len() != 0 {
+		t.Errorf("expected oversized entry not to be cached")
 	}
 }
 
-func TestCollapser_CacheExpiry(t *testing.T) {
-	c := NewCollapser(Config{
-		ResultCacheDuration: 50 * time.Millisecond,
-		BackendTimeout:      5 * time.Second,
-		CleanupInterval:     10 * time.Millisecond,
-	})
-	c.Start()
-	defer c.Stop()
+func TestDiskCache_DeleteExpired(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("failed to create disk cache: %v", err)
+	}
+	now := time.Now()
+	cache.Set("expired", Entry[[]byte]{Value: []byte("result"), ExpiresAt: now.Add(-time.Minute)})
+	cache.Set("fresh", Entry[[]byte]{Value: []byte("result"), ExpiresAt: now.Add(time.Minute)})
 
-	var backendCalls int64
-	fn := func(ctx context.Context) ([]byte, error) {
-		atomic.AddInt64(&backendCalls, 1)
-		return []byte("result"), nil
+	// Expiry comes from the modification time, so unreadable files go too
+	if err := os.WriteFile(cache.path("corrupt"), []byte("not gob"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.Chtimes(cache.path("corrupt"), time.Time{}, now.Add(-time.Minute)); err != nil {
+		t.Fatalf("failed to touch file: %v", err)
 	}
 
-	// First call
-	c.Execute(context.Background(), "key1", fn)
+	cache.DeleteExpired(now)
+	if _, ok := cache.Get("expired"); ok {
+		t.Errorf("expected the expired entry to be deleted")
+	}
+	if _, err := os.Stat(cache.path("corrupt")); !os.IsNotExist(err) {
+		t.Errorf("expected the expired file to be deleted without decoding it")
+	}
+	if _, ok := cache.Get("fresh"); !ok {
+		t.Errorf("expected the fresh entry to stay cached")
+	}
+}
 
-	// Wait for cache to expire
-	time.Sleep(100 * time.Millisecond)
+func TestShardedCache_GlobalBudget(t *testing.T) {
+	entry := Entry[[]byte]{Value: []byte("result"), ExpiresAt: time.Now().Add(time.Hour)}
 
-	// Second call (cache expired, should execute again)
-	c.Execute(context.Background(), "key1", fn)
+	// Fewer entries than shards are not rounded up per shard
+	cache := NewShardedCache(32, 10, 0, ByteSize)
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), entry)
+	}
+	if cache.Len() != 10 {
+		t.Errorf("expected 10 cached entries, got %d", cache.Len())
+	}
+	if _, ok := cache.Get("key99"); !ok {
+		t.Errorf("expected the latest entry to stay cached")
+	}
 
-	if backendCalls != 2 {
-		t.Errorf("expected 2 backend calls (cache expired), got %d", backendCalls)
+	// An entry may use most of the budget, whichever shard it lands in
+	cache = NewShardedCache(32, 0, 1000, ByteSize)
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), Entry[[]byte]{Value: make([]byte, 100)})
+	}
+	cache.Set("large", Entry[[]byte]{Value: make([]byte, 600)})
+	if _, ok := cache.Get("large"); !ok {
+		t.Errorf("expected an entry within the whole budget to be cached")
+	}
+	if cache.Bytes() > 1000 {
+		t.Errorf("cache exceeds byte budget: %d bytes", cache.Bytes())
+	}
+	cache.Set("huge", Entry[[]byte]{Value: make([]byte, 2000)})
+	if _, ok := cache.Get("huge"); ok {
+		t.Errorf("expected oversized entry not to be cached")
 	}
 }
 
-func TestCollapser_ClientCancellation(t *testing.T) {
-	c := NewCollapser(Config{
-		ResultCacheDuration: 100 * time.Millisecond,
-		BackendTimeout:      10 * time.Second,
+func TestCollapser_NegativeCachePolicy(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration:   1 * time.Hour,
+		BackendTimeout:        5 * time.Second,
+		CleanupInterval:       1 * time.Second,
+		NegativeCacheDuration: 1 * time.Hour,
+		NegativeCachePolicy: map[codes.Code]time.Duration{
+			codes.Unavailable: 0,
+		},
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls int64
+		unavailable := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			return nil, status.Error(codes.Unavailable, "backend down")
+		}
+		notFound := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			return nil, status.Error(codes.NotFound, "no such thing")
+		}
+
+		// Unavailable is never cached
+		c.Execute(context.Background(), "key1", unavailable)
+		c.Execute(context.Background(), "key1", unavailable)
+		if backendCalls != 2 {
+			t.Errorf("expected Unavailable not to be cached, got %d backend calls", backendCalls)
+		}
+
+		// Other codes fall back to NegativeCacheDuration
+		c.Execute(context.Background(), "key2", notFound)
+		_, err := c.Execute(context.Background(), "key2", notFound)
+		if backendCalls != 3 {
+			t.Errorf("expected NotFound to be cached, got %d backend calls", backendCalls)
+		}
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("expected cached NotFound, got %v", err)
+		}
+	})
+}
+
+func TestCollapser_ErrorsNotCachedByDefault(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration: 1 * time.Hour,
+		BackendTimeout:      5 * time.Second,
 		CleanupInterval:     1 * time.Second,
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			return nil, errors.New("backend error")
+		}
+
+		c.Execute(context.Background(), "key1", fn)
+		c.Execute(context.Background(), "key1", fn)
+		if backendCalls != 2 {
+			t.Errorf("expected errors not to be cached, got %d backend calls", backendCalls)
+		}
 	})
-	c.Start()
-	defer c.Stop()
+}
+
+func TestCollapser_StaleWhileRevalidate(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration:  50 * time.Millisecond,
+		BackendTimeout:       5 * time.Second,
+		CleanupInterval:      10 * time.Millisecond,
+		StaleWhileRevalidate: 1 * time.Second,
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			n := atomic.AddInt64(&backendCalls, 1)
+			time.Sleep(50 * time.Millisecond)
+			return []byte{byte('0' + n)}, nil
+		}
 
-	var backendCalls int64
-	var backendCompleted int64
+		c.Execute(context.Background(), "key1", fn)
 
-	fn := func(ctx context.Context) ([]byte, error) {
-		atomic.AddInt64(&backendCalls, 1)
+		// Wait for the entry to expire, but stay within the stale window
 		time.Sleep(100 * time.Millisecond)
-		atomic.AddInt64(&backendCompleted, 1)
-		return []byte("result"), nil
-	}
-
-	// Client 1: cancels immediately
-	ctx1, cancel1 := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		_, err := c.Execute(ctx1, "key1", fn)
-		if err != context.Canceled {
-			t.Errorf("expected context.Canceled, got %v", err)
-		}
-	}()
-
-	// Cancel immediately
-	cancel1()
-
-	// Client 2: waits for result
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		time.Sleep(10 * time.Millisecond) // Start after client1
-		data, err := c.Execute(context.Background(), "key1", fn)
-		if err != nil {
-			t.Errorf("unexpected error: %v", err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				data, err := c.Execute(context.Background(), "key1", fn)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if string(data) != "1" {
+					t.Errorf("expected stale result '1', got %s", data)
+				}
+				if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+					t.Errorf("stale read waited for backend: %v", elapsed)
+				}
+			}()
 		}
-		if string(data) != "result" {
-			t.Errorf("expected 'result', got %s", data)
+		wg.Wait()
+
+		// Let the single background refresh land
+		time.Sleep(100 * time.Millisecond)
+
+		if n := atomic.LoadInt64(&backendCalls); n != 2 {
+			t.Errorf("expected 1 background refresh, got %d backend calls", n)
+		}
+		data, _ := c.Execute(context.Background(), "key1", fn)
+		if string(data) != "2" {
+			t.Errorf("expected refreshed result '2', got %s", data)
+		}
+	})
+}
+
+func TestCollapser_StaleIfError(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration: 50 * time.Millisecond,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     10 * time.Millisecond,
+		StaleIfError:        1 * time.Second,
+	}, func(t *testing.T, c *Collapser) {
+		_, _ = c.Execute(context.Background(), "key1", func(ctx context.Context) ([]byte, error) {
+			return []byte("good"), nil
+		})
+
+		// Let the entry expire and survive a cleanup pass
+		time.Sleep(100 * time.Millisecond)
+
+		failing := func(ctx context.Context) ([]byte, error) {
+			time.Sleep(20 * time.Millisecond)
+			return nil, status.Error(codes.Unavailable, "backend down")
 		}
-	}()
 
-	wg.Wait()
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, outcome, err := c.ExecuteWithOutcome(context.Background(), "key1", failing)
+				if err != nil {
+					t.Errorf("expected stale data instead of error, got %v", err)
+				}
+				if string(data) != "good" {
+					t.Errorf("expected stale 'good', got %s", data)
+				}
+				if !outcome.Stale {
+					t.Errorf("expected outcome to be marked stale")
+				}
+			}()
+		}
+		wg.Wait()
 
-	// Backend should complete despite client1 cancellation
-	if backendCompleted != 1 {
-		t.Errorf("backend should complete, got %d completions", backendCompleted)
-	}
+		// Keys without a previous result still see the error
+		if _, err := c.Execute(context.Background(), "key2", failing); status.Code(err) != codes.Unavailable {
+			t.Errorf("expected Unavailable for uncached key, got %v", err)
+		}
+	})
 }
 
-func TestCollapser_ErrorPropagation(t *testing.T) {
-	c := NewCollapser(Config{
-		ResultCacheDuration: 100 * time.Millisecond,
-		BackendTimeout:      10 * time.Second,
-		CleanupInterval:     1 * time.Second,
+func TestCollapser_CancelAbandonedCalls(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration:  1 * time.Hour,
+		BackendTimeout:       5 * time.Second,
+		CleanupInterval:      1 * time.Second,
+		CancelAbandonedCalls: true,
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls, cancelled int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			select {
+			case <-ctx.Done():
+				atomic.AddInt64(&cancelled, 1)
+				return nil, ctx.Err()
+			case <-time.After(1 * time.Second):
+				return []byte("result"), nil
+			}
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+				defer cancel()
+				if _, err := c.Execute(ctx, "key1", fn); err != context.DeadlineExceeded {
+					t.Errorf("expected context.DeadlineExceeded, got %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// The backend call is cancelled once every caller is gone
+		time.Sleep(20 * time.Millisecond)
+		if n := atomic.LoadInt64(&cancelled); n != 1 {
+			t.Fatalf("expected backend call to be cancelled, got %d cancellations", n)
+		}
+
+		// Nothing was cached, so the next caller starts a fresh call
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		defer cancel()
+		c.Execute(ctx, "key1", fn)
+		if n := atomic.LoadInt64(&backendCalls); n != 2 {
+			t.Errorf("expected 2 backend calls, got %d", n)
+		}
 	})
-	c.Start()
-	defer c.Stop()
+}
 
-	expectedErr := errors.New("backend error")
-	fn := func(ctx context.Context) ([]byte, error) {
-		return nil, expectedErr
-	}
+func TestCollapser_CancelAbandonedCalls_WaiterKeepsCallAlive(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration:  100 * time.Millisecond,
+		BackendTimeout:       5 * time.Second,
+		CleanupInterval:      1 * time.Second,
+		CancelAbandonedCalls: true,
+	}, func(t *testing.T, c *Collapser) {
+		fn := func(ctx context.Context) ([]byte, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(50 * time.Millisecond):
+				return []byte("result"), nil
+			}
+		}
 
-	// Multiple requests should all get the same error
-	var wg sync.WaitGroup
-	for i := 0; i < 10; i++ {
-		wg.Add(1)
+		// The leader gives up early
+		leaderCtx, cancel := context.WithCancel(context.Background())
 		go func() {
-			defer wg.Done()
-			_, err := c.Execute(context.Background(), "key1", fn)
-			if err != expectedErr {
-				t.Errorf("expected backend error, got %v", err)
-			}
+			time.Sleep(10 * time.Millisecond)
+			cancel()
 		}()
-	}
+		go c.Execute(leaderCtx, "key1", fn)
 
-	wg.Wait()
+		// A follower that joined before cancellation keeps the call alive
+		time.Sleep(5 * time.Millisecond)
+		data, err := c.Execute(context.Background(), "key1", fn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(data) != "result" {
+			t.Errorf("expected 'result', got %s", data)
+		}
+	})
 }
 
-func TestCollapser_MultipleKeys(t *testing.T) {
-	c := NewCollapser(Config{
-		ResultCacheDuration: 100 * time.Millisecond,
-		BackendTimeout:      10 * time.Second,
-		CleanupInterval:     1 * time.Second,
+func TestCollapser_LeaderPanic(t *testing.T) {
+	forEachCache(t, Config{
+		ResultCacheDuration:   100 * time.Millisecond,
+		BackendTimeout:        5 * time.Second,
+		CleanupInterval:       1 * time.Second,
+		NegativeCacheDuration: 1 * time.Hour,
+	}, func(t *testing.T, c *Collapser) {
+		var backendCalls int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&backendCalls, 1)
+			time.Sleep(20 * time.Millisecond)
+			panic("boom")
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+				defer cancel()
+				_, err := c.Execute(ctx, "key1", fn)
+				var panicErr *PanicError
+				if !errors.As(err, &panicErr) {
+					t.Errorf("expected PanicError, got %v", err)
+				}
+				if status.Code(err) != codes.Internal {
+					t.Errorf("expected codes.Internal, got %v", status.Code(err))
+				}
+			}()
+		}
+		wg.Wait()
+
+		// The key is not stuck and the panic was not cached
+		data, err := c.Execute(context.Background(), "key1", func(ctx context.Context) ([]byte, error) {
+			return []byte("recovered"), nil
+		})
+		if err != nil || string(data) != "recovered" {
+			t.Errorf("expected fresh execution after panic, got %q, %v", data, err)
+		}
+		if n := atomic.LoadInt64(&backendCalls); n != 1 {
+			t.Errorf("expected 1 panicking backend call, got %d", n)
+		}
 	})
-	c.Start()
-	defer c.Stop()
+}
 
-	var backendCalls int64
-	fn := func(ctx context.Context) ([]byte, error) {
-		atomic.AddInt64(&backendCalls, 1)
-		time.Sleep(50 * time.Millisecond)
-		return []byte("result"), nil
+func TestCollapser_Policy(t *testing.T) {
+	cfg := Config{
+		ResultCacheDuration: 1 * time.Hour,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     1 * time.Second,
 	}
 
-	var wg sync.WaitGroup
-
-	// 50 requests for key1
-	for i := 0; i < 50; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			c.Execute(context.Background(), "key1", fn)
-		}()
+	// concurrent runs 5 identical calls at once and then one more, and
+	// returns how many backend calls were made
+	concurrent := func(c *Collapser, key string, policy Policy) int64 {
+		var calls int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&calls, 1)
+			time.Sleep(20 * time.Millisecond)
+			return []byte("result"), nil
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, _, err := c.ExecuteWithPolicy(context.Background(), key, policy, fn); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		c.ExecuteWithPolicy(context.Background(), key, policy, fn)
+		return atomic.LoadInt64(&calls)
 	}
 
-	// 50 requests for key2
-	for i := 0; i < 50; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			c.Execute(context.Background(), "key2", fn)
-		}()
-	}
+	forEachCache(t, cfg, func(t *testing.T, c *Collapser) {
+		if n := concurrent(c, "default", Policy{}); n != 1 {
+			t.Errorf("collapse+cache: expected 1 backend call, got %d", n)
+		}
+		if n := concurrent(c, "collapse-only", Policy{NoCache: true}); n != 2 {
+			t.Errorf("collapse-only: expected 2 backend calls, got %d", n)
+		}
+		if n := concurrent(c, "cache-only", Policy{NoCollapse: true}); n != 5 {
+			t.Errorf("cache-only: expected 5 backend calls, got %d", n)
+		}
+	})
 
-	wg.Wait()
+	forEachCache(t, cfg, func(t *testing.T, c *Collapser) {
+		var calls int64
+		fn := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&calls, 1)
+			return []byte("result"), nil
+		}
+		policy := Policy{ResultCacheDuration: 20 * time.Millisecond}
+		c.ExecuteWithPolicy(context.Background(), "ttl", policy, fn)
+		c.ExecuteWithPolicy(context.Background(), "ttl", policy, fn)
+		time.Sleep(30 * time.Millisecond)
+		c.ExecuteWithPolicy(context.Background(), "ttl", policy, fn)
+		if n := atomic.LoadInt64(&calls); n != 2 {
+			t.Errorf("expected per-call TTL to expire the result, got %d backend calls", n)
+		}
 
-	// Should have 2 backend calls (one per key)
-	if backendCalls != 2 {
-		t.Errorf("expected 2 backend calls, got %d", backendCalls)
-	}
+		_, _, err := c.ExecuteWithPolicy(context.Background(), "timeout", Policy{BackendTimeout: 10 * time.Millisecond}, func(ctx context.Context) ([]byte, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected per-call timeout, got %v", err)
+		}
+
+		calls = 0
+		notFound := func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt64(&calls, 1)
+			return nil, status.Error(codes.NotFound, "missing")
+		}
+		policy = Policy{NegativeCachePolicy: map[codes.Code]time.Duration{codes.NotFound: time.Hour}}
+		c.ExecuteWithPolicy(context.Background(), "negative", policy, notFound)
+		c.ExecuteWithPolicy(context.Background(), "negative", policy, notFound)
+		if n := atomic.LoadInt64(&calls); n != 1 {
+			t.Errorf("expected per-call negative caching, got %d backend calls", n)
+		}
+	})
 }
@@ -0,0 +1,564 @@
+package collapser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/logger"
+	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+)
+
+// Group collapses concurrent calls for the same key into a single execution
+// and caches the result, for any comparable key and any value type. It is the
+// engine behind Collapser.
+type Group[K comparable, V any] struct {
+	config Config
+
+	seed   maphash.Seed
+	shards []*shard[K, V]
+	cache  Cache[K, V]
+	peers  PeerPicker
+
+	// retryBudget bounds retries when Config.Retry sets a budget.
+	retryBudget *retryBudget
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Result is delivered by DoChan.
+type Result[V any] struct {
+	Val     V
+	Err     error
+	Outcome Outcome
+}
+
+// shard owns the inflight calls for a subset of keys, so unrelated keys do
+// not contend on a single lock.
+type shard[K comparable, V any] struct {
+	mu       sync.Mutex
+	inflight map[K]*inflightCall[V]
+}
+
+type inflightCall[V any] struct {
+	policy  Policy
+	state   atomic.Int32
+	waiters []chan result[V]
+	res     *result[V]
+	mu      sync.Mutex
+
+	// Set only under CancelAbandonedCalls. refs counts callers still waiting
+	// for the result; cancel aborts the backend call once it drops to zero.
+	// leaderCh is the leader's own entry in waiters.
+	refs      int
+	cancel    context.CancelFunc
+	leaderCh  chan result[V]
+	abandoned bool
+	// forgotten calls are not cached when they complete.
+	forgotten bool
+}
+
+type result[V any] struct {
+	val    V
+	err    error
+	stale  bool
+	shared bool
+}
+
+// NewGroup creates a Group. WithPeers requires string keys.
+func NewGroup[K comparable, V any](cfg Config, opts ...Option) *Group[K, V] {
+	if cfg.Shards <= 0 {
+		cfg.Shards = DefaultShards
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	g := &Group[K, V]{
+		config: cfg,
+		seed:   maphash.MakeSeed(),
+		shards: make([]*shard[K, V], cfg.Shards),
+		peers:  o.peers,
+		stopCh: make(chan struct{}),
+	}
+	for i := range g.shards {
+		g.shards[i] = &shard[K, V]{inflight: make(map[K]*inflightCall[V])}
+	}
+	if cfg.Retry.enabled() && cfg.Retry.BudgetPercent > 0 {
+		g.retryBudget = newRetryBudget(cfg.Retry.BudgetPercent)
+	}
+
+	if o.peers != nil {
+		var zero K
+		if _, ok := any(zero).(string); !ok {
+			panic("collapser: WithPeers requires string keys")
+		}
+	}
+	switch cache := o.cache.(type) {
+	case nil:
+		sizeOf, _ := o.sizeOf.(func(K, V) int64)
+		g.cache = NewShardedCache(cfg.Shards, cfg.MaxCacheEntries, cfg.MaxCacheBytes, sizeOf)
+	case Cache[K, V]:
+		g.cache = cache
+	default:
+		panic(fmt.Sprintf("collapser: WithCache got %T, want Cache[%T, %T]", o.cache, *new(K), *new(V)))
+	}
+	return g
+}
+
+func (g *Group[K, V]) Start() error {
+	g.wg.Add(1)
+	go g.cleanupLoop()
+	return nil
+}
+
+func (g *Group[K, V]) Stop() error {
+	close(g.stopCh)
+	g.wg.Wait()
+
+	for _, s := range g.shards {
+		s.mu.Lock()
+		for key, call := range s.inflight {
+			call.mu.Lock()
+			waiters := call.waiters
+			call.waiters = nil
+			call.mu.Unlock()
+			g.notifyWaiters(result[V]{err: fmt.Errorf("shutting down")}, waiters...)
+			delete(s.inflight, key)
+		}
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Do executes fn for key, unless an identical call is inflight or a cached
+// result exists, in which case that result is returned instead.
+func (g *Group[K, V]) Do(ctx context.Context, key K, fn func(context.Context) (V, error)) (V, error) {
+	v, _, err := g.DoOutcome(ctx, key, fn)
+	return v, err
+}
+
+// DoChan is like Do but delivers the result on a channel.
+func (g *Group[K, V]) DoChan(ctx context.Context, key K, fn func(context.Context) (V, error)) <-chan Result[V] {
+	ch := make(chan Result[V], 1)
+	go func() {
+		v, outcome, err := g.DoOutcome(ctx, key, fn)
+		ch <- Result[V]{Val: v, Err: err, Outcome: outcome}
+	}()
+	return ch
+}
+
+// Forget drops the cached result for key and detaches any inflight call, so
+// the next Do executes fn again. Callers already waiting still receive the
+// detached call's result, which is not cached.
+func (g *Group[K, V]) Forget(key K) {
+	s := g.shard(key)
+	s.mu.Lock()
+	if call, exists := s.inflight[key]; exists {
+		call.mu.Lock()
+		call.forgotten = true
+		call.mu.Unlock()
+		delete(s.inflight, key)
+	}
+	s.mu.Unlock()
+	g.cache.Delete(key)
+}
+
+// DoOutcome is like Do but also reports how the result was produced, so
+// callers can tell clients when they received stale data.
+func (g *Group[K, V]) DoOutcome(ctx context.Context, key K, fn func(context.Context) (V, error)) (V, Outcome, error) {
+	return g.DoPolicy(ctx, key, Policy{}, fn)
+}
+
+// DoPolicy is like DoOutcome but applies policy to this call. Calls for the
+// same key should use the same policy; followers share the leader's.
+func (g *Group[K, V]) DoPolicy(ctx context.Context, key K, policy Policy, fn func(context.Context) (V, error)) (V, Outcome, error) {
+	var zero V
+	monitoring.RequestsTotal.Inc()
+
+	if err := ctx.Err(); err != nil {
+		return zero, Outcome{}, err
+	}
+
+	s := g.shard(key)
+
+	// 1. Check result cache
+	now := time.Now()
+	if cached, exists := g.cachedEntry(key, policy); exists {
+		if now.Before(cached.ExpiresAt) {
+			if cached.Err != nil {
+				monitoring.ErrorCacheHitsTotal.Inc()
+			} else {
+				monitoring.CacheHitsTotal.Inc()
+			}
+			return cached.Value, Outcome{Cached: true}, cached.Err
+		}
+		// Serve stale data while a single background leader refreshes it
+		if cached.Err == nil && now.Before(cached.ExpiresAt.Add(g.config.StaleWhileRevalidate)) {
+			s.mu.Lock()
+			if _, refreshing := s.inflight[key]; !refreshing {
+				call := g.newCall(s, key, policy)
+				go g.lead(context.Background(), s, key, call, isLocalExecution(ctx), fn)
+			}
+			s.mu.Unlock()
+			monitoring.StaleResponsesTotal.WithLabelValues(staleReasonRevalidate).Inc()
+			return cached.Value, Outcome{Cached: true, Stale: true}, nil
+		}
+	}
+
+	if policy.NoCollapse {
+		return g.runAlone(ctx, key, policy, fn)
+	}
+
+	// 2. Check inflight
+	s.mu.Lock()
+	if call, exists := s.inflight[key]; exists {
+		monitoring.CollapsedRequestsTotal.Inc()
+		waiterCh := make(chan result[V], 1)
+
+		call.mu.Lock()
+		// Double check if it just finished
+		if State(call.state.Load()) == StateDone {
+			res := *call.res
+			call.mu.Unlock()
+			s.mu.Unlock()
+			return res.val, Outcome{Stale: res.stale, Shared: true}, res.err
+		}
+		call.waiters = append(call.waiters, waiterCh)
+		call.refs++
+		call.mu.Unlock()
+		s.mu.Unlock()
+
+		return g.wait(ctx, s, key, call, waiterCh)
+	}
+
+	// 3. Become leader
+	call := g.newCall(s, key, policy)
+	if !g.config.CancelAbandonedCalls {
+		s.mu.Unlock()
+		res := g.lead(context.Background(), s, key, call, isLocalExecution(ctx), fn)
+		return res.val, Outcome{Stale: res.stale, Shared: res.shared}, res.err
+	}
+
+	// Run the backend call on behalf of everyone interested and wait for it
+	// like a follower, so the leader can give up without killing it
+	waiterCh := make(chan result[V], 1)
+	call.waiters = append(call.waiters, waiterCh)
+	call.leaderCh = waiterCh
+	call.refs = 1
+	backendCtx, cancel := context.WithCancel(context.Background())
+	call.cancel = cancel
+	s.mu.Unlock()
+
+	go g.lead(backendCtx, s, key, call, isLocalExecution(ctx), fn)
+	return g.wait(ctx, s, key, call, waiterCh)
+}
+
+// wait blocks until call delivers its result on waiterCh or ctx ends.
+func (g *Group[K, V]) wait(ctx context.Context, s *shard[K, V], key K, call *inflightCall[V], waiterCh chan result[V]) (V, Outcome, error) {
+	select {
+	case res := <-waiterCh:
+		return res.val, Outcome{Stale: res.stale, Shared: res.shared}, res.err
+	case <-ctx.Done():
+		g.release(s, key, call)
+		var zero V
+		return zero, Outcome{}, ctx.Err()
+	}
+}
+
+// release drops a departed caller's interest in call. Under
+// CancelAbandonedCalls the backend call is cancelled once nobody is left;
+// the entry is removed from inflight first so later callers start afresh.
+func (g *Group[K, V]) release(s *shard[K, V], key K, call *inflightCall[V]) {
+	if call.cancel == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	call.refs--
+	if call.refs > 0 || State(call.state.Load()) == StateDone {
+		return
+	}
+	call.abandoned = true
+	if s.inflight[key] == call {
+		delete(s.inflight, key)
+	}
+	call.cancel()
+	monitoring.AbandonedCallsTotal.Inc()
+}
+
+// shard returns the shard owning key.
+func (g *Group[K, V]) shard(key K) *shard[K, V] {
+	return g.shards[maphash.Comparable(g.seed, key)%uint64(len(g.shards))]
+}
+
+// newCall registers a new inflight call for key. The caller must hold s.mu.
+func (g *Group[K, V]) newCall(s *shard[K, V], key K, policy Policy) *inflightCall[V] {
+	call := &inflightCall[V]{
+		policy:  policy,
+		waiters: make([]chan result[V], 0),
+	}
+	call.state.Store(int32(StateExecuting))
+	s.inflight[key] = call
+	monitoring.InflightRequests.Inc()
+	monitoring.BackendCallsTotal.Inc()
+	return call
+}
+
+// lead executes fn on behalf of every caller attached to call, then moves
+// the result from inflight to the cache. ctx is detached from the callers
+// and is only cancelled when the call is abandoned.
+func (g *Group[K, V]) lead(ctx context.Context, s *shard[K, V], key K, call *inflightCall[V], local bool, fn func(context.Context) (V, error)) result[V] {
+	if call.cancel != nil {
+		defer call.cancel()
+	}
+
+	res := g.run(ctx, key, call.policy, local, fn)
+	val, err := res.val, res.err
+
+	// 4. Update inflight state and notify
+	call.mu.Lock()
+	waiters := call.waiters
+	call.waiters = nil
+	followers := len(waiters)
+	if call.leaderCh != nil {
+		followers--
+	}
+	res.shared = followers > 0
+	call.res = &res
+	call.state.Store(int32(StateDone))
+	keep := !call.abandoned && !call.forgotten
+	call.mu.Unlock()
+
+	followerRes := res
+	followerRes.shared = true
+	for _, ch := range waiters {
+		if ch == call.leaderCh {
+			g.notifyWaiters(res, ch)
+		} else {
+			g.notifyWaiters(followerRes, ch)
+		}
+	}
+
+	// 5. Cache result and move from inflight to cache. Abandoned and
+	// forgotten calls were already removed from inflight and are not cached.
+	if keep && !res.stale {
+		g.store(key, call.policy, val, err)
+	}
+	s.mu.Lock()
+	if s.inflight[key] == call {
+		delete(s.inflight, key)
+	}
+	monitoring.InflightRequests.Dec()
+	s.mu.Unlock()
+
+	return res
+}
+
+// runAlone executes fn for a caller that does not collapse with others. Its
+// result is still cached unless the policy says otherwise or the caller
+// went away.
+func (g *Group[K, V]) runAlone(ctx context.Context, key K, policy Policy, fn func(context.Context) (V, error)) (V, Outcome, error) {
+	monitoring.InflightRequests.Inc()
+	defer monitoring.InflightRequests.Dec()
+	monitoring.BackendCallsTotal.Inc()
+
+	res := g.run(ctx, key, policy, isLocalExecution(ctx), fn)
+	// The call ran on the caller's context, so a caller that went away says
+	// nothing about the key, just like an abandoned collapsed call
+	if !res.stale && ctx.Err() == nil {
+		g.store(key, policy, res.val, res.err)
+	}
+	return res.val, Outcome{Stale: res.stale}, res.err
+}
+
+// run executes fn within the backend timeout and substitutes a stale result
+// for errors when the StaleIfError policy allows.
+func (g *Group[K, V]) run(ctx context.Context, key K, policy Policy, local bool, fn func(context.Context) (V, error)) result[V] {
+	backendCtx, cancel := context.WithTimeout(ctx, g.Timeout(policy))
+	defer cancel()
+
+	start := time.Now()
+	val, stale, err := g.execute(backendCtx, key, local, fn)
+	monitoring.BackendLatency.Observe(time.Since(start).Seconds())
+
+	if err != nil && !policy.NoCache {
+		if stale, ok := g.staleOnError(key); ok {
+			return stale
+		}
+	}
+	return result[V]{val: val, err: err, stale: stale}
+}
+
+// Timeout returns how long a backend call under policy may take.
+func (g *Group[K, V]) Timeout(policy Policy) time.Duration {
+	if policy.BackendTimeout > 0 {
+		return policy.BackendTimeout
+	}
+	return g.config.BackendTimeout
+}
+
+// cachedEntry looks key up in the cache unless policy bypasses it.
+func (g *Group[K, V]) cachedEntry(key K, policy Policy) (Entry[V], bool) {
+	if policy.NoCache {
+		return Entry[V]{}, false
+	}
+	return g.cache.Get(key)
+}
+
+// store caches a result for as long as policy and the negative caching
+// configuration allow.
+func (g *Group[K, V]) store(key K, policy Policy, val V, err error) {
+	if policy.NoCache {
+		return
+	}
+	if ttl := g.cacheDuration(err, policy); ttl > 0 {
+		g.cache.Set(key, Entry[V]{
+			Value:     val,
+			Err:       err,
+			ExpiresAt: time.Now().Add(ttl),
+		})
+	}
+}
+
+// execute runs fn for key, letting it forward to the owning peer when one is
+// configured and falling back to local execution if that peer is unreachable.
+// It also reports whether the peer marked its result stale.
+func (g *Group[K, V]) execute(ctx context.Context, key K, local bool, fn func(context.Context) (V, error)) (V, bool, error) {
+	if g.peers != nil && !local {
+		if peer, ok := g.peers.PickPeer(any(key).(string)); ok {
+			monitoring.PeerForwardsTotal.Inc()
+			var stale atomic.Bool
+			peerCtx := context.WithValue(context.WithValue(ctx, peerCtxKey{}, peer), staleCtxKey{}, &stale)
+			val, err := g.call(peerCtx, key, fn)
+			if !errors.Is(err, ErrPeerUnavailable) {
+				return val, err == nil && stale.Load(), err
+			}
+			monitoring.PeerFallbacksTotal.Inc()
+			logger.Warn("peer unavailable, executing locally", zap.String("peer", peer), zap.Error(err))
+		}
+	}
+	val, err := g.callWithRetries(ctx, key, fn)
+	return val, false, err
+}
+
+// call invokes fn, converting a panic into a PanicError so the leader still
+// notifies its waiters and clears the inflight entry.
+func (g *Group[K, V]) call(ctx context.Context, key K, fn func(context.Context) (V, error)) (val V, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			monitoring.LeaderPanicsTotal.Inc()
+			logger.Error("panic in collapsed call",
+				zap.Any("key", key),
+				zap.Any("panic", r),
+				zap.ByteString("stack", stack))
+			var zero V
+			val, err = zero, &PanicError{Value: r, Stack: stack}
+		}
+	}()
+	return fn(ctx)
+}
+
+// staleOnError returns the expired result for key if it is recent enough to
+// be served in place of a backend error under the StaleIfError policy.
+func (g *Group[K, V]) staleOnError(key K) (result[V], bool) {
+	if g.config.StaleIfError <= 0 {
+		return result[V]{}, false
+	}
+
+	cached, exists := g.cache.Get(key)
+	if !exists || cached.Err != nil || time.Now().After(cached.ExpiresAt.Add(g.config.StaleIfError)) {
+		return result[V]{}, false
+	}
+	monitoring.StaleResponsesTotal.WithLabelValues(staleReasonError).Inc()
+	return result[V]{val: cached.Value, stale: true}, true
+}
+
+// cacheDuration returns how long a result with the given error should be
+// cached. Errors are governed by the negative caching policy.
+func (g *Group[K, V]) cacheDuration(err error, policy Policy) time.Duration {
+	if err == nil {
+		if policy.ResultCacheDuration > 0 {
+			return policy.ResultCacheDuration
+		}
+		return g.config.ResultCacheDuration
+	}
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		return 0
+	}
+	code := status.Code(err)
+	if ttl, ok := policy.NegativeCachePolicy[code]; ok {
+		return ttl
+	}
+	if ttl, ok := g.config.NegativeCachePolicy[code]; ok {
+		return ttl
+	}
+	return g.config.NegativeCacheDuration
+}
+
+func (g *Group[K, V]) notifyWaiters(res result[V], waiters ...chan result[V]) {
+	for _, ch := range waiters {
+		func(waiterCh chan result[V]) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error("panic notifying waiter", zap.Any("panic", r))
+				}
+			}()
+			select {
+			case waiterCh <- res:
+			default:
+			}
+			close(waiterCh)
+		}(ch)
+	}
+}
+
+func (g *Group[K, V]) cleanupLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.config.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.cleanup()
+		case <-g.stopCh:
+			return
+		}
+	}
+}
+
+func (g *Group[K, V]) cleanup() {
+	// Keep expired results around while they can still be served stale
+	now := time.Now().Add(-max(g.config.StaleWhileRevalidate, g.config.StaleIfError))
+	if cache, ok := g.cache.(expiringCache); ok {
+		cache.DeleteExpired(now)
+		return
+	}
+	var expired []K
+	g.cache.Range(func(key K, entry Entry[V]) bool {
+		if now.After(entry.ExpiresAt) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	for _, key := range expired {
+		g.cache.Delete(key)
+	}
+}
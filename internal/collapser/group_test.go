@@ -0,0 +1,188 @@
+package collapser
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type user struct {
+	ID   int
+	Name string
+}
+
+func newTestGroup[K comparable, V any](t *testing.T, cfg Config) *Group[K, V] {
+	g := NewGroup[K, V](cfg)
+	g.Start()
+	t.Cleanup(func() { g.Stop() })
+	return g
+}
+
+func TestGroup_DoTyped(t *testing.T) {
+	g := newTestGroup[int, *user](t, Config{
+		ResultCacheDuration: 1 * time.Hour,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     1 * time.Second,
+	})
+
+	var backendCalls int64
+	fn := func(ctx context.Context) (*user, error) {
+		atomic.AddInt64(&backendCalls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return &user{ID: 42, Name: "gopher"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u, err := g.Do(context.Background(), 42, fn)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if u.Name != "gopher" {
+				t.Errorf("expected 'gopher', got %q", u.Name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, outcome, _ := g.DoOutcome(context.Background(), 42, fn)
+	if !outcome.Cached {
+		t.Errorf("expected cached outcome")
+	}
+	if n := atomic.LoadInt64(&backendCalls); n != 1 {
+		t.Errorf("expected 1 backend call, got %d", n)
+	}
+}
+
+func TestGroup_DoChan(t *testing.T) {
+	g := newTestGroup[string, int](t, Config{
+		ResultCacheDuration: 100 * time.Millisecond,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     1 * time.Second,
+	})
+
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		<-release
+		return 7, nil
+	}
+
+	ch1 := g.DoChan(context.Background(), "key1", fn)
+	time.Sleep(10 * time.Millisecond)
+	ch2 := g.DoChan(context.Background(), "key1", fn)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for _, ch := range []<-chan Result[int]{ch1, ch2} {
+		res := <-ch
+		if res.Err != nil || res.Val != 7 {
+			t.Errorf("expected 7, got %d, %v", res.Val, res.Err)
+		}
+		if !res.Outcome.Shared {
+			t.Errorf("expected result to be shared")
+		}
+	}
+}
+
+func TestGroup_Forget(t *testing.T) {
+	g := newTestGroup[string, int](t, Config{
+		ResultCacheDuration: 1 * time.Hour,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     1 * time.Second,
+	})
+
+	var backendCalls int64
+	fn := func(ctx context.Context) (int, error) {
+		return int(atomic.AddInt64(&backendCalls, 1)), nil
+	}
+
+	g.Do(context.Background(), "key1", fn)
+	g.Forget("key1")
+	v, _ := g.Do(context.Background(), "key1", fn)
+	if v != 2 {
+		t.Errorf("expected fresh execution after Forget, got %d", v)
+	}
+
+	// Forgetting an inflight call detaches it without caching its result
+	release := make(chan struct{})
+	slow := func(ctx context.Context) (int, error) {
+		<-release
+		return 100, nil
+	}
+	g.Forget("key2")
+	ch := g.DoChan(context.Background(), "key2", slow)
+	time.Sleep(10 * time.Millisecond)
+	g.Forget("key2")
+	close(release)
+	if res := <-ch; res.Val != 100 {
+		t.Errorf("expected detached call to still deliver, got %d", res.Val)
+	}
+	v, _ = g.Do(context.Background(), "key2", fn)
+	if v != 3 {
+		t.Errorf("expected forgotten result not to be cached, got %d", v)
+	}
+}
+
+func TestGroup_CacheOnlyIgnoresCallerCancellation(t *testing.T) {
+	g := newTestGroup[string, string](t, Config{
+		ResultCacheDuration:   time.Hour,
+		NegativeCacheDuration: time.Hour,
+		BackendTimeout:        5 * time.Second,
+		CleanupInterval:       1 * time.Second,
+	})
+	policy := Policy{NoCollapse: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, _, err := g.DoPolicy(ctx, "key", policy, func(ctx context.Context) (string, error) {
+		cancel()
+		return "", ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected the caller's cancellation, got %v", err)
+	}
+
+	v, outcome, err := g.DoPolicy(context.Background(), "key", policy, func(ctx context.Context) (string, error) {
+		return "ok", nil
+	})
+	if err != nil || v != "ok" || outcome.Cached {
+		t.Errorf("expected a fresh call, got %q, %+v, %v", v, outcome, err)
+	}
+}
+
+func TestGroup_SharedUnderCancelAbandonedCalls(t *testing.T) {
+	g := newTestGroup[string, int](t, Config{
+		BackendTimeout:       5 * time.Second,
+		CleanupInterval:      1 * time.Second,
+		CancelAbandonedCalls: true,
+	})
+
+	_, outcome, err := g.DoOutcome(context.Background(), "alone", func(ctx context.Context) (int, error) {
+		return 7, nil
+	})
+	if err != nil || outcome.Shared {
+		t.Errorf("expected a lone caller not to be shared, got %+v, %v", outcome, err)
+	}
+
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		<-release
+		return 7, nil
+	}
+	ch1 := g.DoChan(context.Background(), "key", fn)
+	time.Sleep(10 * time.Millisecond)
+	ch2 := g.DoChan(context.Background(), "key", fn)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for _, ch := range []<-chan Result[int]{ch1, ch2} {
+		if res := <-ch; !res.Outcome.Shared {
+			t.Errorf("expected the collapsed result to be shared, got %+v", res.Outcome)
+		}
+	}
+}
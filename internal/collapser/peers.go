@@ -0,0 +1,113 @@
+package collapser
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// ErrPeerUnavailable is returned (wrapped) by a forwarding fn when the owning
+// peer could not be reached. The collapser then executes the key locally.
+var ErrPeerUnavailable = errors.New("peer unavailable")
+
+// PeerPicker decides which proxy replica owns a key.
+type PeerPicker interface {
+	// PickPeer returns the address of the replica that owns key, or false
+	// when the local replica owns it.
+	PickPeer(key string) (string, bool)
+}
+
+// WithPeers makes the collapser forward keys owned by other replicas to them,
+// so identical requests collapse across the whole fleet.
+func WithPeers(picker PeerPicker) Option {
+	return func(o *options) {
+		o.peers = picker
+	}
+}
+
+type peerCtxKey struct{}
+type localCtxKey struct{}
+type staleCtxKey struct{}
+
+// PeerFromContext returns the owning peer the fn passed to Execute should
+// forward the request to. It is only set on the backend context of leaders
+// for keys owned by another replica.
+func PeerFromContext(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(peerCtxKey{}).(string)
+	return addr, ok
+}
+
+// MarkStale reports that the owning peer served expired data, so the result
+// is passed on as stale instead of being cached as fresh. It only has an
+// effect on contexts that carry a peer.
+func MarkStale(ctx context.Context) {
+	if stale, ok := ctx.Value(staleCtxKey{}).(*atomic.Bool); ok {
+		stale.Store(true)
+	}
+}
+
+// WithLocalExecution marks ctx so Execute never forwards to a peer. Owners use
+// it for requests already forwarded by another replica to avoid loops.
+func WithLocalExecution(ctx context.Context) context.Context {
+	return context.WithValue(ctx, localCtxKey{}, true)
+}
+
+func isLocalExecution(ctx context.Context) bool {
+	local, _ := ctx.Value(localCtxKey{}).(bool)
+	return local
+}
+
+// HashRing assigns keys to peers with consistent hashing, so adding or
+// removing a replica only moves a fraction of the keys.
+type HashRing struct {
+	self     string
+	hashes   []uint32
+	owners   map[uint32]string
+	replicas int
+}
+
+// NewHashRing builds a ring over peers, placing each one replicas times.
+// self is the address of the local replica as it appears in peers.
+func NewHashRing(self string, peers []string, replicas int) *HashRing {
+	if replicas < 1 {
+		replicas = 1
+	}
+	r := &HashRing{
+		self:     self,
+		owners:   make(map[uint32]string),
+		replicas: replicas,
+	}
+	for _, peer := range peers {
+		for i := 0; i < replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			r.hashes = append(r.hashes, hash)
+			r.owners[hash] = peer
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owner returns the peer owning key, or "" if the ring is empty.
+func (r *HashRing) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.owners[r.hashes[idx]]
+}
+
+func (r *HashRing) PickPeer(key string) (string, bool) {
+	owner := r.Owner(key)
+	if owner == "" || owner == r.self {
+		return "", false
+	}
+	return owner, true
+}
@@ -0,0 +1,139 @@
+package collapser
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/logger"
+	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy retries a failed execution before its result reaches the
+// leader and every waiter, so a transient backend error is not fanned out to
+// all of them. Retries happen within the BackendTimeout of the call.
+type RetryPolicy struct {
+	// MaxAttempts is the number of executions per call, including the
+	// first. Zero or one disables retries.
+	MaxAttempts int
+	// Codes are the gRPC status codes worth retrying. Panics are never
+	// retried.
+	Codes []codes.Code
+
+	// InitialBackoff is the longest wait before the first retry, doubled
+	// for each further retry up to MaxBackoff. The actual wait is drawn
+	// uniformly below it. Zero uses 25ms and 1s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// BudgetPercent caps retries at this percentage of calls, with a
+	// reserve of RetryBudgetReserve retries for quiet periods, so a failing
+	// backend is not hit by a retry storm. Zero leaves retries unbounded.
+	BudgetPercent float64
+}
+
+// RetryBudgetReserve is how many retries the budget holds when full.
+const RetryBudgetReserve = 10
+
+func (p RetryPolicy) enabled() bool {
+	return p.MaxAttempts > 1 && len(p.Codes) > 0
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		return false
+	}
+	return slices.Contains(p.Codes, status.Code(err))
+}
+
+// backoff returns the wait before retry n, counting from 1.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	initial, ceiling := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = 25 * time.Millisecond
+	}
+	if ceiling <= 0 {
+		ceiling = time.Second
+	}
+	d := initial
+	for i := 1; i < n && d < ceiling; i++ {
+		d *= 2
+	}
+	return rand.N(min(d, ceiling) + 1)
+}
+
+// retryBudget is a token bucket filled by calls and drained by retries.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func newRetryBudget(percent float64) *retryBudget {
+	return &retryBudget{ratio: percent / 100, tokens: RetryBudgetReserve}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = min(b.tokens+b.ratio, RetryBudgetReserve)
+	b.mu.Unlock()
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// callWithRetries invokes fn, retrying it under the RetryPolicy while the
+// error is retryable, the budget allows and ctx leaves time for the backoff.
+func (g *Group[K, V]) callWithRetries(ctx context.Context, key K, fn func(context.Context) (V, error)) (V, error) {
+	policy := g.config.Retry
+	if g.retryBudget != nil {
+		g.retryBudget.deposit()
+	}
+	for attempt := 1; ; attempt++ {
+		monitoring.BackendAttemptsTotal.Inc()
+		val, err := g.call(ctx, key, fn)
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			return val, err
+		}
+
+		wait := policy.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+			monitoring.BackendRetriesSkippedTotal.WithLabelValues("deadline").Inc()
+			return val, err
+		}
+		if g.retryBudget != nil && !g.retryBudget.withdraw() {
+			monitoring.BackendRetriesSkippedTotal.WithLabelValues("budget").Inc()
+			return val, err
+		}
+
+		code := status.Code(err)
+		monitoring.BackendRetriesTotal.WithLabelValues(code.String()).Inc()
+		logger.Debug("retrying backend call",
+			zap.Any("key", key),
+			zap.String("code", code.String()),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", wait))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return val, err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package collapser
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGroup_RetriesLeaderCall(t *testing.T) {
+	g := newTestGroup[string, string](t, Config{
+		BackendTimeout:  5 * time.Second,
+		CleanupInterval: time.Second,
+		Retry: RetryPolicy{
+			MaxAttempts:    3,
+			Codes:          []codes.Code{codes.Unavailable},
+			InitialBackoff: time.Millisecond,
+		},
+	})
+
+	var attempts atomic.Int64
+	fn := func(ctx context.Context) (string, error) {
+		if attempts.Add(1) == 1 {
+			time.Sleep(20 * time.Millisecond)
+			return "", status.Error(codes.Unavailable, "connection reset")
+		}
+		return "ok", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := g.Do(context.Background(), "key", fn); err != nil || v != "ok" {
+				t.Errorf("expected every caller to get the retried result, got %q, %v", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+
+	// Codes outside the policy fail straight away
+	attempts.Store(0)
+	_, err := g.Do(context.Background(), "other", func(ctx context.Context) (string, error) {
+		attempts.Add(1)
+		return "", status.Error(codes.InvalidArgument, "bad request")
+	})
+	if status.Code(err) != codes.InvalidArgument || attempts.Load() != 1 {
+		t.Errorf("expected a single attempt for a non-retryable code, got %d and %v", attempts.Load(), err)
+	}
+
+	// As do panics
+	attempts.Store(0)
+	g.Do(context.Background(), "panic", func(ctx context.Context) (string, error) {
+		attempts.Add(1)
+		panic("boom")
+	})
+	if attempts.Load() != 1 {
+		t.Errorf("expected panics not to be retried, got %d attempts", attempts.Load())
+	}
+}
+
+func TestGroup_RetriesStayWithinBackendTimeout(t *testing.T) {
+	g := newTestGroup[string, string](t, Config{
+		BackendTimeout:  100 * time.Millisecond,
+		CleanupInterval: time.Second,
+		Retry: RetryPolicy{
+			MaxAttempts:    1000,
+			Codes:          []codes.Code{codes.Unavailable},
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     10 * time.Millisecond,
+		},
+	})
+
+	start := time.Now()
+	_, err := g.Do(context.Background(), "key", func(ctx context.Context) (string, error) {
+		return "", status.Error(codes.Unavailable, "down")
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected the last attempt's error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected retries to stop at the backend timeout, took %v", elapsed)
+	}
+}
+
+func TestGroup_RetryBudget(t *testing.T) {
+	g := newTestGroup[int, string](t, Config{
+		BackendTimeout:  5 * time.Second,
+		CleanupInterval: time.Second,
+		Retry: RetryPolicy{
+			MaxAttempts:    2,
+			Codes:          []codes.Code{codes.Unavailable},
+			InitialBackoff: time.Microsecond,
+			BudgetPercent:  10,
+		},
+	})
+
+	var attempts atomic.Int64
+	fn := func(ctx context.Context) (string, error) {
+		attempts.Add(1)
+		return "", status.Error(codes.Unavailable, "down")
+	}
+	const calls = 50
+	for i := 0; i < calls; i++ {
+		g.Do(context.Background(), i, fn)
+	}
+
+	// The reserve plus 10% of the calls
+	retries := attempts.Load() - calls
+	if retries < RetryBudgetReserve || retries > RetryBudgetReserve+calls/10 {
+		t.Errorf("expected the budget to cap retries, got %d", retries)
+	}
+}
@@ -0,0 +1,313 @@
+package collapser
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
+	"google.golang.org/grpc/metadata"
+)
+
+// StreamSource yields the messages of an upstream stream. Recv returns
+// io.EOF once the stream has ended successfully.
+type StreamSource interface {
+	Recv() ([]byte, error)
+}
+
+// MetadataSource is implemented by StreamSources with response metadata to
+// share. Header is read before the first message and Trailer once Recv has
+// returned an error.
+type MetadataSource interface {
+	Header() (metadata.MD, error)
+	Trailer() metadata.MD
+}
+
+// StreamConfig configures a StreamGroup.
+type StreamConfig struct {
+	// MaxReplayMessages bounds how many messages are kept for late joiners.
+	// Once a stream has sent more, callers arriving later open their own
+	// upstream stream instead of attaching. Zero disables late joining.
+	MaxReplayMessages int
+
+	// SubscriberBuffer is how many messages may be queued for a subscriber
+	// before it slows down the shared upstream. Zero uses a default.
+	SubscriberBuffer int
+}
+
+const defaultSubscriberBuffer = 64
+
+// StreamGroup collapses identical server-streaming calls into one upstream
+// stream whose messages are fanned out to every attached subscriber.
+type StreamGroup struct {
+	config StreamConfig
+
+	mu       sync.Mutex
+	inflight map[string]*broadcast
+}
+
+// broadcast is one upstream stream shared by its subscribers.
+type broadcast struct {
+	mu         sync.Mutex
+	replay     [][]byte
+	overflowed bool
+	done       bool
+	err        error
+	header     metadata.MD
+	trailer    metadata.MD
+	subs       []*subscriber
+	cancel     context.CancelFunc
+}
+
+type subscriber struct {
+	ch   chan []byte
+	done chan struct{}
+}
+
+func NewStreamGroup(cfg StreamConfig) *StreamGroup {
+	if cfg.SubscriberBuffer <= 0 {
+		cfg.SubscriberBuffer = defaultSubscriberBuffer
+	}
+	return &StreamGroup{
+		config:   cfg,
+		inflight: make(map[string]*broadcast),
+	}
+}
+
+// Stream delivers every message of the stream identified by key to send,
+// attaching to an identical inflight stream when possible and opening a new
+// upstream through open otherwise. It returns the upstream's final error,
+// or nil when the stream ended cleanly.
+func (g *StreamGroup) Stream(ctx context.Context, key string, open func(context.Context) (StreamSource, error), send func([]byte) error) error {
+	_, err := g.StreamWithMetadata(ctx, key, open, send, nil)
+	return err
+}
+
+// StreamWithMetadata is like Stream, but also shares the response metadata
+// of upstreams that are a MetadataSource: setHeader, when not nil, gets the
+// header before the first message, and the trailer is returned at the end.
+func (g *StreamGroup) StreamWithMetadata(ctx context.Context, key string, open func(context.Context) (StreamSource, error), send func([]byte) error, setHeader func(metadata.MD) error) (metadata.MD, error) {
+	monitoring.RequestsTotal.Inc()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	if b, exists := g.inflight[key]; exists {
+		b.mu.Lock()
+		if !b.overflowed {
+			sub, replay := b.subscribe(g.config.SubscriberBuffer)
+			b.mu.Unlock()
+			g.mu.Unlock()
+			monitoring.CollapsedRequestsTotal.Inc()
+			return g.deliver(ctx, key, b, sub, replay, send, setHeader)
+		}
+		b.mu.Unlock()
+	}
+
+	// Become leader of a new upstream stream. It runs detached from the
+	// leader so it outlives it while other subscribers remain.
+	upstreamCtx, cancel := context.WithCancel(context.Background())
+	b := &broadcast{cancel: cancel}
+	sub, _ := b.subscribe(g.config.SubscriberBuffer)
+	g.inflight[key] = b
+	g.mu.Unlock()
+
+	monitoring.BackendCallsTotal.Inc()
+	monitoring.InflightRequests.Inc()
+	src, err := open(upstreamCtx)
+	if err != nil {
+		g.finish(key, b, nil, err)
+		return g.deliver(ctx, key, b, sub, nil, send, setHeader)
+	}
+	go g.pump(key, b, src)
+
+	return g.deliver(ctx, key, b, sub, nil, send, setHeader)
+}
+
+// subscribe registers a new subscriber and returns the messages it missed.
+// The caller must hold b.mu.
+func (b *broadcast) subscribe(buffer int) (*subscriber, [][]byte) {
+	sub := &subscriber{
+		ch:   make(chan []byte, buffer),
+		done: make(chan struct{}),
+	}
+	if b.done {
+		// Finished streams only deliver their replay and final error
+		close(sub.ch)
+	} else {
+		b.subs = append(b.subs, sub)
+	}
+	return sub, slices.Clone(b.replay)
+}
+
+// deliver sends the header, the replayed and then live messages to one
+// subscriber, and returns the trailer and final error.
+func (g *StreamGroup) deliver(ctx context.Context, key string, b *broadcast, sub *subscriber, replay [][]byte, send func([]byte) error, setHeader func(metadata.MD) error) (metadata.MD, error) {
+	// pump stores the header before the first message reaches the replay or
+	// a subscriber, so it is known whenever one is sent
+	headerSent := setHeader == nil
+	sendHeader := func() error {
+		if headerSent {
+			return nil
+		}
+		headerSent = true
+		b.mu.Lock()
+		header := b.header
+		b.mu.Unlock()
+		if len(header) == 0 {
+			return nil
+		}
+		return setHeader(header)
+	}
+
+	for _, msg := range replay {
+		if err := sendHeader(); err != nil {
+			g.leave(key, b, sub)
+			return nil, err
+		}
+		if err := send(msg); err != nil {
+			g.leave(key, b, sub)
+			return nil, err
+		}
+	}
+
+	for {
+		select {
+		case msg, ok := <-sub.ch:
+			if !ok {
+				if err := sendHeader(); err != nil {
+					return nil, err
+				}
+				b.mu.Lock()
+				trailer, err := b.trailer, b.err
+				b.mu.Unlock()
+				return trailer, err
+			}
+			if err := sendHeader(); err != nil {
+				g.leave(key, b, sub)
+				return nil, err
+			}
+			if err := send(msg); err != nil {
+				g.leave(key, b, sub)
+				return nil, err
+			}
+		case <-ctx.Done():
+			g.leave(key, b, sub)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pump reads the upstream stream and fans each message out to subscribers,
+// keeping it for late joiners until the replay limit is exceeded.
+func (g *StreamGroup) pump(key string, b *broadcast, src StreamSource) {
+	md, _ := src.(MetadataSource)
+	if md != nil {
+		// A failed header read surfaces again from Recv
+		header, _ := md.Header()
+		b.mu.Lock()
+		b.header = header
+		b.mu.Unlock()
+	}
+	for {
+		msg, err := src.Recv()
+		if err != nil {
+			var trailer metadata.MD
+			if md != nil {
+				trailer = md.Trailer()
+			}
+			g.finish(key, b, trailer, err)
+			return
+		}
+
+		overflowed := false
+		b.mu.Lock()
+		if !b.overflowed {
+			if len(b.replay) < g.config.MaxReplayMessages {
+				b.replay = append(b.replay, msg)
+			} else {
+				// Late joiners can no longer see the whole stream
+				b.overflowed = true
+				b.replay = nil
+				overflowed = true
+			}
+		}
+		subs := slices.Clone(b.subs)
+		b.mu.Unlock()
+
+		if overflowed {
+			g.detach(key, b)
+			monitoring.StreamReplayOverflowsTotal.Inc()
+		}
+
+		for _, sub := range subs {
+			select {
+			case sub.ch <- msg:
+			case <-sub.done:
+			}
+		}
+	}
+}
+
+// finish records the upstream's trailer and final error and releases every
+// subscriber.
+func (g *StreamGroup) finish(key string, b *broadcast, trailer metadata.MD, err error) {
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	b.mu.Lock()
+	if b.done {
+		b.mu.Unlock()
+		return
+	}
+	b.done = true
+	b.err = err
+	b.trailer = trailer
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		close(sub.ch)
+	}
+	b.cancel()
+	monitoring.InflightRequests.Dec()
+
+	// Callers that attached just before this still get the full replay
+	g.detach(key, b)
+}
+
+// leave detaches a subscriber that stopped early and cancels the upstream
+// once nobody is left listening.
+func (g *StreamGroup) leave(key string, b *broadcast, sub *subscriber) {
+	close(sub.done)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs = slices.DeleteFunc(b.subs, func(s *subscriber) bool { return s == sub })
+	if len(b.subs) > 0 || b.done {
+		return
+	}
+	if g.inflight[key] == b {
+		delete(g.inflight, key)
+	}
+	b.cancel()
+	monitoring.AbandonedCallsTotal.Inc()
+}
+
+// detach removes b from inflight so later callers open a new stream.
+func (g *StreamGroup) detach(key string, b *broadcast) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.inflight[key] == b {
+		delete(g.inflight, key)
+	}
+}
@@ -0,0 +1,143 @@
+package collapser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chanSource is a StreamSource fed by the test through a channel.
+type chanSource struct {
+	ctx  context.Context
+	msgs chan []byte
+}
+
+func (s *chanSource) Recv() ([]byte, error) {
+	select {
+	case msg, ok := <-s.msgs:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// upstream opens chanSources and counts how many were opened.
+type upstream struct {
+	opened  atomic.Int64
+	mu      sync.Mutex
+	sources []*chanSource
+}
+
+func (u *upstream) open(ctx context.Context) (StreamSource, error) {
+	u.opened.Add(1)
+	src := &chanSource{ctx: ctx, msgs: make(chan []byte)}
+	u.mu.Lock()
+	u.sources = append(u.sources, src)
+	u.mu.Unlock()
+	return src, nil
+}
+
+func (u *upstream) source(i int) *chanSource {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.sources[i]
+}
+
+// collect runs a subscriber in the background and returns its messages.
+func collect(g *StreamGroup, ctx context.Context, key string, open func(context.Context) (StreamSource, error)) <-chan []string {
+	out := make(chan []string, 1)
+	go func() {
+		var msgs []string
+		_ = g.Stream(ctx, key, open, func(msg []byte) error {
+			msgs = append(msgs, string(msg))
+			return nil
+		})
+		out <- msgs
+	}()
+	return out
+}
+
+func TestStreamGroup_FanOutAndReplay(t *testing.T) {
+	g := NewStreamGroup(StreamConfig{MaxReplayMessages: 10})
+	u := &upstream{}
+
+	first := collect(g, context.Background(), "key1", u.open)
+	time.Sleep(10 * time.Millisecond)
+
+	src := u.source(0)
+	src.msgs <- []byte("m1")
+	src.msgs <- []byte("m2")
+
+	// A late joiner receives a replay of m1 and m2, then the live stream
+	late := collect(g, context.Background(), "key1", u.open)
+	time.Sleep(10 * time.Millisecond)
+	src.msgs <- []byte("m3")
+	close(src.msgs)
+
+	want := "[m1 m2 m3]"
+	for _, ch := range []<-chan []string{first, late} {
+		if got := fmt.Sprint(<-ch); got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	}
+	if n := u.opened.Load(); n != 1 {
+		t.Errorf("expected 1 upstream stream, got %d", n)
+	}
+}
+
+func TestStreamGroup_ReplayOverflowStartsNewUpstream(t *testing.T) {
+	g := NewStreamGroup(StreamConfig{MaxReplayMessages: 2})
+	u := &upstream{}
+
+	first := collect(g, context.Background(), "key1", u.open)
+	time.Sleep(10 * time.Millisecond)
+
+	src := u.source(0)
+	for i := 1; i <= 3; i++ {
+		src.msgs <- []byte(fmt.Sprintf("m%d", i))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// The replay buffer overflowed, so this caller gets its own upstream
+	late := collect(g, context.Background(), "key1", u.open)
+	time.Sleep(10 * time.Millisecond)
+	if n := u.opened.Load(); n != 2 {
+		t.Fatalf("expected 2 upstream streams, got %d", n)
+	}
+	close(src.msgs)
+	lateSrc := u.source(1)
+	lateSrc.msgs <- []byte("n1")
+	close(lateSrc.msgs)
+
+	if got := fmt.Sprint(<-first); got != "[m1 m2 m3]" {
+		t.Errorf("expected [m1 m2 m3], got %s", got)
+	}
+	if got := fmt.Sprint(<-late); got != "[n1]" {
+		t.Errorf("expected [n1], got %s", got)
+	}
+}
+
+func TestStreamGroup_CancelsUpstreamWhenAllLeave(t *testing.T) {
+	g := NewStreamGroup(StreamConfig{MaxReplayMessages: 10})
+	u := &upstream{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := collect(g, ctx, "key1", u.open)
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	<-done
+
+	select {
+	case <-u.source(0).ctx.Done():
+	case <-time.After(1 * time.Second):
+		t.Fatal("expected upstream stream to be cancelled")
+	}
+}
@@ -2,9 +2,13 @@ package config
 
 import (
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"google.golang.org/grpc/codes"
 )
 
 type Config struct {
@@ -12,14 +16,104 @@ type Config struct {
 	GRPCPort    int `envconfig:"GRPC_PORT" default:"50052"`
 	MetricsPort int `envconfig:"METRICS_PORT" default:"2112"`
 
+	// Listener TLS, enabled when a certificate is set; a client CA enables mTLS
+	TLSCertFile     string `envconfig:"TLS_CERT_FILE"`
+	TLSKeyFile      string `envconfig:"TLS_KEY_FILE"`
+	TLSClientCAFile string `envconfig:"TLS_CLIENT_CA_FILE"`
+
 	// Backend
-	BackendAddress string        `envconfig:"BACKEND_ADDRESS" required:"true"`
+	// BackendAddress may only be empty when METHOD_CONFIG_FILE defines
+	// clusters, which then replace it.
+	BackendAddress string        `envconfig:"BACKEND_ADDRESS"`
 	BackendTimeout time.Duration `envconfig:"BACKEND_TIMEOUT" default:"10s"`
 	BackendUseTLS  bool          `envconfig:"BACKEND_USE_TLS" default:"false"`
 
+	BackendTLSCAFile     string `envconfig:"BACKEND_TLS_CA_FILE"`
+	BackendTLSCertFile   string `envconfig:"BACKEND_TLS_CERT_FILE"`
+	BackendTLSKeyFile    string `envconfig:"BACKEND_TLS_KEY_FILE"`
+	BackendTLSServerName string `envconfig:"BACKEND_TLS_SERVER_NAME"`
+
+	BackendPoolSize         int           `envconfig:"BACKEND_POOL_SIZE" default:"4"`
+	BackendKeepaliveTime    time.Duration `envconfig:"BACKEND_KEEPALIVE_TIME" default:"5m"`
+	BackendKeepaliveTimeout time.Duration `envconfig:"BACKEND_KEEPALIVE_TIMEOUT" default:"20s"`
+
+	// Balancing over a backend's addresses, and grpc.health.v1 checks that
+	// take failing ones out of rotation (an interval of 0 disables them)
+	BackendLBPolicy           string        `envconfig:"BACKEND_LB_POLICY" default:"round-robin"`
+	BackendHealthInterval     time.Duration `envconfig:"BACKEND_HEALTH_CHECK_INTERVAL" default:"0s"`
+	BackendHealthTimeout      time.Duration `envconfig:"BACKEND_HEALTH_CHECK_TIMEOUT" default:"1s"`
+	BackendHealthService      string        `envconfig:"BACKEND_HEALTH_CHECK_SERVICE"`
+	BackendUnhealthyThreshold int           `envconfig:"BACKEND_UNHEALTHY_THRESHOLD" default:"3"`
+	BackendHealthyThreshold   int           `envconfig:"BACKEND_HEALTHY_THRESHOLD" default:"1"`
+
+	// Passive outlier detection ejecting addresses whose calls keep failing
+	// or are far slower than the others (0 disables either check)
+	OutlierConsecutiveErrors  int           `envconfig:"BACKEND_OUTLIER_CONSECUTIVE_ERRORS" default:"0"`
+	OutlierLatencyFactor      float64       `envconfig:"BACKEND_OUTLIER_LATENCY_FACTOR" default:"0"`
+	OutlierInterval           time.Duration `envconfig:"BACKEND_OUTLIER_INTERVAL" default:"10s"`
+	OutlierBaseEjectionTime   time.Duration `envconfig:"BACKEND_OUTLIER_BASE_EJECTION_TIME" default:"30s"`
+	OutlierMaxEjectionTime    time.Duration `envconfig:"BACKEND_OUTLIER_MAX_EJECTION_TIME" default:"5m"`
+	OutlierMaxEjectionPercent int           `envconfig:"BACKEND_OUTLIER_MAX_EJECTION_PERCENT" default:"10"`
+
 	// Collapser
-	ResultCacheDuration time.Duration `envconfig:"COLLAPSER_CACHE_DURATION" default:"100ms"`
-	CleanupInterval     time.Duration `envconfig:"COLLAPSER_CLEANUP_INTERVAL" default:"1s"`
+	ResultCacheDuration  time.Duration `envconfig:"COLLAPSER_CACHE_DURATION" default:"100ms"`
+	CleanupInterval      time.Duration `envconfig:"COLLAPSER_CLEANUP_INTERVAL" default:"1s"`
+	MaxCacheEntries      int           `envconfig:"COLLAPSER_CACHE_MAX_ENTRIES" default:"10000"`
+	MaxCacheBytes        int64         `envconfig:"COLLAPSER_CACHE_MAX_BYTES" default:"67108864"`
+	Shards               int           `envconfig:"COLLAPSER_SHARDS" default:"32"`
+	CacheStore           string        `envconfig:"COLLAPSER_CACHE_STORE" default:"sharded"`
+	CacheDir             string        `envconfig:"COLLAPSER_CACHE_DIR" default:"/tmp/collapser-cache"`
+	StaleWhileRevalidate time.Duration `envconfig:"COLLAPSER_STALE_WHILE_REVALIDATE" default:"0s"`
+	StaleIfError         time.Duration `envconfig:"COLLAPSER_STALE_IF_ERROR" default:"0s"`
+	CancelAbandonedCalls bool          `envconfig:"COLLAPSER_CANCEL_ABANDONED" default:"false"`
+
+	// Peer replicas for distributed collapsing
+	Peers        []string `envconfig:"COLLAPSER_PEERS"`
+	SelfAddress  string   `envconfig:"COLLAPSER_SELF_ADDRESS"`
+	PeerReplicas int      `envconfig:"COLLAPSER_PEER_REPLICAS" default:"50"`
+
+	// Peers are dialed over TLS when the listener uses it, presenting
+	// TLS_CERT_FILE and verifying peers against PEER_TLS_CA_FILE
+	PeerTLSCAFile     string `envconfig:"PEER_TLS_CA_FILE"`
+	PeerTLSServerName string `envconfig:"PEER_TLS_SERVER_NAME"`
+
+	// Negative caching of backend errors
+	NegativeCacheDuration time.Duration            `envconfig:"COLLAPSER_NEGATIVE_CACHE_DURATION" default:"0s"`
+	NegativeCacheCodes    map[string]time.Duration `envconfig:"COLLAPSER_NEGATIVE_CACHE_CODES" default:"NOT_FOUND:1s,UNAVAILABLE:0s,DEADLINE_EXCEEDED:0s,INTERNAL:0s"`
+
+	// Retries of failed leader calls within BACKEND_TIMEOUT, capped at a
+	// percentage of calls (1 attempt disables retries)
+	RetryMaxAttempts    int           `envconfig:"COLLAPSER_RETRY_MAX_ATTEMPTS" default:"1"`
+	RetryCodes          []string      `envconfig:"COLLAPSER_RETRY_CODES" default:"UNAVAILABLE"`
+	RetryInitialBackoff time.Duration `envconfig:"COLLAPSER_RETRY_INITIAL_BACKOFF" default:"25ms"`
+	RetryMaxBackoff     time.Duration `envconfig:"COLLAPSER_RETRY_MAX_BACKOFF" default:"1s"`
+	RetryBudgetPercent  float64       `envconfig:"COLLAPSER_RETRY_BUDGET_PERCENT" default:"20"`
+
+	// Client metadata propagated to the backend; keys may end in '*'
+	MetadataAllow []string `envconfig:"METADATA_ALLOW"`
+	MetadataDeny  []string `envconfig:"METADATA_DENY"`
+
+	// Metadata that is part of the collapse key, and credential metadata
+	// that prevents collapsing unless it is part of the key
+	KeyMetadata        []string `envconfig:"COLLAPSER_KEY_METADATA"`
+	CredentialMetadata []string `envconfig:"COLLAPSER_CREDENTIAL_METADATA" default:"authorization,cookie,proxy-authorization,x-api-key"`
+
+	// Request descriptors for canonical keys, from a FileDescriptorSet file
+	// or the backend's server reflection service
+	DescriptorSetFile    string `envconfig:"DESCRIPTOR_SET_FILE"`
+	DescriptorReflection bool   `envconfig:"DESCRIPTOR_REFLECTION" default:"false"`
+
+	// Per-method rules, see MethodConfig. Methods matching no rule follow
+	// their descriptor's annotations, or use DefaultMode when undescribed.
+	MethodConfigFile string `envconfig:"METHOD_CONFIG_FILE"`
+	DefaultMode      string `envconfig:"COLLAPSER_DEFAULT_MODE" default:"passthrough"`
+
+	// Server-streaming methods collapsed with replayable fan-out
+	ServerStreamingMethods []string `envconfig:"SERVER_STREAMING_METHODS"`
+	StreamReplayLimit      int      `envconfig:"STREAM_REPLAY_LIMIT" default:"1000"`
+
+	// Client-streaming and bidi methods piped to the backend uncollapsed
+	PassthroughMethods []string `envconfig:"PASSTHROUGH_METHODS"`
 
 	// Logging
 	LogLevel  string `envconfig:"LOG_LEVEL" default:"info"`
@@ -47,11 +141,139 @@ func (c *Config) Validate() error {
 	if c.MetricsPort < 1 || c.MetricsPort > 65535 {
 		return fmt.Errorf("invalid METRICS_PORT: %d", c.MetricsPort)
 	}
-	if c.BackendAddress == "" {
+	if c.BackendAddress == "" && c.MethodConfigFile == "" {
 		return fmt.Errorf("BACKEND_ADDRESS cannot be empty")
 	}
 	if c.BackendTimeout <= 0 {
 		return fmt.Errorf("BACKEND_TIMEOUT must be positive")
 	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		return fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE")
+	}
+	if (c.PeerTLSCAFile != "" || c.PeerTLSServerName != "") && c.TLSCertFile == "" {
+		return fmt.Errorf("PEER_TLS_* settings require TLS_CERT_FILE")
+	}
+	if (c.BackendTLSCertFile == "") != (c.BackendTLSKeyFile == "") {
+		return fmt.Errorf("BACKEND_TLS_CERT_FILE and BACKEND_TLS_KEY_FILE must be set together")
+	}
+	if !c.BackendUseTLS && (c.BackendTLSCAFile != "" || c.BackendTLSCertFile != "" || c.BackendTLSServerName != "") {
+		return fmt.Errorf("BACKEND_TLS_* settings require BACKEND_USE_TLS=true")
+	}
+	if c.BackendPoolSize < 1 {
+		return fmt.Errorf("BACKEND_POOL_SIZE must be positive")
+	}
+	if c.BackendKeepaliveTime < 0 || c.BackendKeepaliveTimeout < 0 {
+		return fmt.Errorf("BACKEND_KEEPALIVE_TIME and BACKEND_KEEPALIVE_TIMEOUT cannot be negative")
+	}
+	if err := ValidateLBPolicy(c.BackendLBPolicy); err != nil {
+		return fmt.Errorf("invalid BACKEND_LB_POLICY: %w", err)
+	}
+	if c.BackendHealthInterval < 0 || c.BackendHealthTimeout < 0 {
+		return fmt.Errorf("BACKEND_HEALTH_CHECK_INTERVAL and BACKEND_HEALTH_CHECK_TIMEOUT cannot be negative")
+	}
+	if c.BackendUnhealthyThreshold < 1 || c.BackendHealthyThreshold < 1 {
+		return fmt.Errorf("BACKEND_UNHEALTHY_THRESHOLD and BACKEND_HEALTHY_THRESHOLD must be positive")
+	}
+	if c.OutlierConsecutiveErrors < 0 || c.OutlierLatencyFactor < 0 {
+		return fmt.Errorf("BACKEND_OUTLIER_CONSECUTIVE_ERRORS and BACKEND_OUTLIER_LATENCY_FACTOR cannot be negative")
+	}
+	if c.OutlierLatencyFactor > 0 && c.OutlierLatencyFactor <= 1 {
+		return fmt.Errorf("BACKEND_OUTLIER_LATENCY_FACTOR must be greater than 1")
+	}
+	if c.OutlierInterval <= 0 || c.OutlierBaseEjectionTime <= 0 || c.OutlierMaxEjectionTime <= 0 {
+		return fmt.Errorf("BACKEND_OUTLIER_INTERVAL and ejection times must be positive")
+	}
+	if c.OutlierMaxEjectionTime < c.OutlierBaseEjectionTime {
+		return fmt.Errorf("BACKEND_OUTLIER_MAX_EJECTION_TIME cannot be below BACKEND_OUTLIER_BASE_EJECTION_TIME")
+	}
+	if c.OutlierMaxEjectionPercent < 1 || c.OutlierMaxEjectionPercent > 100 {
+		return fmt.Errorf("BACKEND_OUTLIER_MAX_EJECTION_PERCENT must be between 1 and 100")
+	}
+	if c.MaxCacheEntries < 0 {
+		return fmt.Errorf("COLLAPSER_CACHE_MAX_ENTRIES cannot be negative")
+	}
+	if c.MaxCacheBytes < 0 {
+		return fmt.Errorf("COLLAPSER_CACHE_MAX_BYTES cannot be negative")
+	}
+	switch c.CacheStore {
+	case "memory", "sharded", "disk":
+	default:
+		return fmt.Errorf("invalid COLLAPSER_CACHE_STORE: %q (want memory, sharded or disk)", c.CacheStore)
+	}
+	if c.Shards < 1 {
+		return fmt.Errorf("COLLAPSER_SHARDS must be positive")
+	}
+	if len(c.Peers) > 0 {
+		if !slices.Contains(c.Peers, c.SelfAddress) {
+			return fmt.Errorf("COLLAPSER_SELF_ADDRESS %q must be one of COLLAPSER_PEERS", c.SelfAddress)
+		}
+		if c.PeerReplicas < 1 {
+			return fmt.Errorf("COLLAPSER_PEER_REPLICAS must be positive")
+		}
+	}
+	if c.StaleWhileRevalidate < 0 {
+		return fmt.Errorf("COLLAPSER_STALE_WHILE_REVALIDATE cannot be negative")
+	}
+	if c.StaleIfError < 0 {
+		return fmt.Errorf("COLLAPSER_STALE_IF_ERROR cannot be negative")
+	}
+	if c.NegativeCacheDuration < 0 {
+		return fmt.Errorf("COLLAPSER_NEGATIVE_CACHE_DURATION cannot be negative")
+	}
+	if c.DescriptorSetFile != "" && c.DescriptorReflection {
+		return fmt.Errorf("DESCRIPTOR_SET_FILE and DESCRIPTOR_REFLECTION are mutually exclusive")
+	}
+	if c.StreamReplayLimit < 0 {
+		return fmt.Errorf("STREAM_REPLAY_LIMIT cannot be negative")
+	}
+	if _, err := c.NegativeCachePolicy(); err != nil {
+		return err
+	}
+	if c.RetryMaxAttempts < 1 {
+		return fmt.Errorf("COLLAPSER_RETRY_MAX_ATTEMPTS must be positive")
+	}
+	if c.RetryInitialBackoff < 0 || c.RetryMaxBackoff < 0 {
+		return fmt.Errorf("COLLAPSER_RETRY_INITIAL_BACKOFF and COLLAPSER_RETRY_MAX_BACKOFF cannot be negative")
+	}
+	if c.RetryBudgetPercent < 0 || c.RetryBudgetPercent > 100 {
+		return fmt.Errorf("COLLAPSER_RETRY_BUDGET_PERCENT must be between 0 and 100")
+	}
+	if _, err := c.RetryPolicyCodes(); err != nil {
+		return err
+	}
 	return nil
 }
+
+// NegativeCachePolicy converts COLLAPSER_NEGATIVE_CACHE_CODES, keyed by gRPC
+// code name (e.g. NOT_FOUND), into per-code error cache durations.
+func (c *Config) NegativeCachePolicy() (map[codes.Code]time.Duration, error) {
+	policy := make(map[codes.Code]time.Duration, len(c.NegativeCacheCodes))
+	for name, ttl := range c.NegativeCacheCodes {
+		var code codes.Code
+		if err := code.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(name)))); err != nil {
+			return nil, fmt.Errorf("invalid COLLAPSER_NEGATIVE_CACHE_CODES code %q", name)
+		}
+		if ttl < 0 {
+			return nil, fmt.Errorf("COLLAPSER_NEGATIVE_CACHE_CODES duration for %s cannot be negative", name)
+		}
+		policy[code] = ttl
+	}
+	return policy, nil
+}
+
+// RetryPolicyCodes converts COLLAPSER_RETRY_CODES, gRPC code names such as
+// UNAVAILABLE, into the codes leader calls are retried on.
+func (c *Config) RetryPolicyCodes() ([]codes.Code, error) {
+	retryCodes := make([]codes.Code, 0, len(c.RetryCodes))
+	for _, name := range c.RetryCodes {
+		var code codes.Code
+		if err := code.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(strings.TrimSpace(name))))); err != nil {
+			return nil, fmt.Errorf("invalid COLLAPSER_RETRY_CODES code %q", name)
+		}
+		retryCodes = append(retryCodes, code)
+	}
+	return retryCodes, nil
+}
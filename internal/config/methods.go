@@ -0,0 +1,231 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written in JSON as a string such as "500ms".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"500ms\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// MethodConfig is the per-method configuration read from METHOD_CONFIG_FILE.
+type MethodConfig struct {
+	Methods []MethodRule `json:"methods"`
+
+	// Clusters and Routes send methods to named backend clusters instead of
+	// BACKEND_ADDRESS. Methods matching no route go to DefaultCluster, or
+	// fail with Unimplemented when it is empty.
+	Clusters       []ClusterConfig `json:"clusters,omitempty"`
+	Routes         []RouteConfig   `json:"routes,omitempty"`
+	DefaultCluster string          `json:"default_cluster,omitempty"`
+}
+
+// ClusterConfig is a named group of backend addresses. Mode, TTL and
+// Timeout, when set, apply to its methods that match no method rule and
+// are not marked as having side effects; without Mode they keep their own.
+// LBPolicy, HealthCheck and OutlierDetection, when set, replace
+// BACKEND_LB_POLICY and the BACKEND_HEALTH_CHECK_* and BACKEND_OUTLIER_*
+// settings.
+type ClusterConfig struct {
+	Name      string      `json:"name"`
+	Addresses []string    `json:"addresses"`
+	TLS       *ClusterTLS `json:"tls,omitempty"`
+
+	LBPolicy    string              `json:"lb_policy,omitempty"`
+	HealthCheck *ClusterHealthCheck `json:"health_check,omitempty"`
+
+	OutlierDetection *ClusterOutlierDetection `json:"outlier_detection,omitempty"`
+
+	Mode    string   `json:"mode,omitempty"`
+	TTL     Duration `json:"ttl,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// ClusterTLS enables TLS to a cluster, like the BACKEND_TLS_* settings do
+// for BACKEND_ADDRESS.
+type ClusterTLS struct {
+	CAFile     string `json:"ca_file,omitempty"`
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// ClusterHealthCheck configures grpc.health.v1 checks of a cluster's
+// addresses. An interval of 0 disables them; other unset fields use the
+// BACKEND_HEALTH_CHECK_* settings.
+type ClusterHealthCheck struct {
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	Service            string   `json:"service,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"`
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty"`
+}
+
+// ClusterOutlierDetection configures the ejection of a cluster's addresses
+// whose calls keep failing or are far slower than the others. A zero
+// consecutive_errors or latency_factor disables that check; other unset
+// fields use the BACKEND_OUTLIER_* settings.
+type ClusterOutlierDetection struct {
+	ConsecutiveErrors  int      `json:"consecutive_errors"`
+	LatencyFactor      float64  `json:"latency_factor"`
+	Interval           Duration `json:"interval,omitempty"`
+	BaseEjectionTime   Duration `json:"base_ejection_time,omitempty"`
+	MaxEjectionTime    Duration `json:"max_ejection_time,omitempty"`
+	MaxEjectionPercent int      `json:"max_ejection_percent,omitempty"`
+}
+
+// ValidateLBPolicy checks a load balancing policy name.
+func ValidateLBPolicy(policy string) error {
+	switch policy {
+	case "", "round-robin", "least-request", "consistent-hash":
+		return nil
+	}
+	return fmt.Errorf("%q (want round-robin, least-request or consistent-hash)", policy)
+}
+
+// RouteConfig sends the methods matching Match to Cluster. Match is a full
+// method name or glob (/pkg.Service/Get*), or a service name or glob
+// (pkg.Service, pkg.*).
+type RouteConfig struct {
+	Match   string `json:"match"`
+	Cluster string `json:"cluster"`
+}
+
+// MethodRule configures the gRPC methods matching Name, either a full
+// method name (/pkg.Service/Method) or a glob such as /pkg.Service/Get*.
+// Exact names take precedence over globs, which are tried in order.
+type MethodRule struct {
+	Name string `json:"name"`
+
+	// Mode is collapse+cache (the default), collapse-only, cache-only or
+	// passthrough. TTL and Timeout override COLLAPSER_CACHE_DURATION and BACKEND_TIMEOUT.
+	Mode    string   `json:"mode,omitempty"`
+	TTL     Duration `json:"ttl,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// IgnoreFields lists dotted field paths (e.g. meta.request_id) left out
+	// of the collapse key. KeyFields instead lists the only paths that are
+	// part of it. Both need request descriptors.
+	IgnoreFields []string `json:"ignore_fields,omitempty"`
+	KeyFields    []string `json:"key_fields,omitempty"`
+}
+
+// LoadMethodConfig reads and validates a JSON method configuration file.
+func LoadMethodConfig(path string) (*MethodConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg MethodConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *MethodConfig) Validate() error {
+	seen := make(map[string]bool)
+	for i, rule := range c.Methods {
+		if !strings.HasPrefix(rule.Name, "/") {
+			return fmt.Errorf("methods[%d]: name %q must look like /pkg.Service/Method", i, rule.Name)
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("methods[%d]: duplicate rule for %s", i, rule.Name)
+		}
+		seen[rule.Name] = true
+		if rule.TTL.Duration < 0 || rule.Timeout.Duration < 0 {
+			return fmt.Errorf("%s: ttl and timeout cannot be negative", rule.Name)
+		}
+		if len(rule.IgnoreFields) > 0 && len(rule.KeyFields) > 0 {
+			return fmt.Errorf("%s: ignore_fields and key_fields are mutually exclusive", rule.Name)
+		}
+		for _, path := range append(rule.IgnoreFields, rule.KeyFields...) {
+			if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+				return fmt.Errorf("%s: invalid field path %q", rule.Name, path)
+			}
+		}
+	}
+
+	clusters := make(map[string]bool)
+	for i, cluster := range c.Clusters {
+		if cluster.Name == "" {
+			return fmt.Errorf("clusters[%d]: name is required", i)
+		}
+		if clusters[cluster.Name] {
+			return fmt.Errorf("clusters[%d]: duplicate cluster %s", i, cluster.Name)
+		}
+		clusters[cluster.Name] = true
+		if len(cluster.Addresses) == 0 {
+			return fmt.Errorf("cluster %s: at least one address is required", cluster.Name)
+		}
+		if cluster.TTL.Duration < 0 || cluster.Timeout.Duration < 0 {
+			return fmt.Errorf("cluster %s: ttl and timeout cannot be negative", cluster.Name)
+		}
+		if tls := cluster.TLS; tls != nil && (tls.CertFile == "") != (tls.KeyFile == "") {
+			return fmt.Errorf("cluster %s: tls cert_file and key_file must be set together", cluster.Name)
+		}
+		if err := ValidateLBPolicy(cluster.LBPolicy); err != nil {
+			return fmt.Errorf("cluster %s: invalid lb_policy %w", cluster.Name, err)
+		}
+		if hc := cluster.HealthCheck; hc != nil {
+			if hc.Interval.Duration < 0 || hc.Timeout.Duration < 0 {
+				return fmt.Errorf("cluster %s: health_check interval and timeout cannot be negative", cluster.Name)
+			}
+			if hc.UnhealthyThreshold < 0 || hc.HealthyThreshold < 0 {
+				return fmt.Errorf("cluster %s: health_check thresholds cannot be negative", cluster.Name)
+			}
+		}
+		if od := cluster.OutlierDetection; od != nil {
+			if od.ConsecutiveErrors < 0 || od.Interval.Duration < 0 || od.BaseEjectionTime.Duration < 0 || od.MaxEjectionTime.Duration < 0 {
+				return fmt.Errorf("cluster %s: outlier_detection settings cannot be negative", cluster.Name)
+			}
+			if od.LatencyFactor != 0 && od.LatencyFactor <= 1 {
+				return fmt.Errorf("cluster %s: outlier_detection latency_factor must be greater than 1", cluster.Name)
+			}
+			if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+				return fmt.Errorf("cluster %s: outlier_detection max_ejection_percent must be between 0 and 100", cluster.Name)
+			}
+		}
+	}
+	for i, route := range c.Routes {
+		if route.Match == "" {
+			return fmt.Errorf("routes[%d]: match is required", i)
+		}
+		if !clusters[route.Cluster] {
+			return fmt.Errorf("routes[%d]: unknown cluster %q", i, route.Cluster)
+		}
+	}
+	if c.DefaultCluster != "" && !clusters[c.DefaultCluster] {
+		return fmt.Errorf("default_cluster: unknown cluster %q", c.DefaultCluster)
+	}
+	return nil
+}
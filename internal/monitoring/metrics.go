@@ -21,11 +21,51 @@ var (
 		Help: "Total backend calls made",
 	})
 
+	UncollapsedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "collapser_uncollapsed_requests_total",
+		Help: "Total requests sent straight to the backend without collapsing or caching",
+	}, []string{"reason"})
+
 	CacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "collapser_cache_hits_total",
 		Help: "Total cache hits",
 	})
 
+	ErrorCacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "collapser_error_cache_hits_total",
+		Help: "Total cache hits that served a cached backend error",
+	})
+
+	StaleResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "collapser_stale_responses_total",
+		Help: "Total responses served from expired cached results",
+	}, []string{"reason"})
+
+	PeerForwardsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "collapser_peer_forwards_total",
+		Help: "Total leader calls forwarded to the owning peer replica",
+	})
+
+	PeerFallbacksTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "collapser_peer_fallbacks_total",
+		Help: "Total forwarded calls executed locally because the owning peer was unreachable",
+	})
+
+	AbandonedCallsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "collapser_abandoned_calls_total",
+		Help: "Total backend calls cancelled because every waiting caller went away",
+	})
+
+	LeaderPanicsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "collapser_leader_panics_total",
+		Help: "Total panics recovered while executing a collapsed backend call",
+	})
+
+	StreamReplayOverflowsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "collapser_stream_replay_overflows_total",
+		Help: "Total collapsed streams that outgrew the replay buffer and stopped accepting late joiners",
+	})
+
 	InflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "collapser_inflight_requests",
 		Help: "Current number of inflight requests",
@@ -36,6 +76,61 @@ var (
 		Help: "Current number of cached results",
 	})
 
+	CachedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "collapser_cached_bytes",
+		Help: "Current size of cached results in bytes",
+	})
+
+	CacheEvictionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "collapser_cache_evictions_total",
+		Help: "Total cached results evicted to stay within cache limits",
+	}, []string{"reason"})
+
+	BackendConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "collapser_backend_connections",
+		Help: "Current number of pooled backend connections by connectivity state",
+	}, []string{"state"})
+
+	BackendConnStateChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "collapser_backend_conn_state_changes_total",
+		Help: "Total connectivity state transitions of pooled backend connections",
+	}, []string{"state"})
+
+	BackendEndpointHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "collapser_backend_endpoint_healthy",
+		Help: "Whether a health-checked backend endpoint is in rotation (1) or not (0)",
+	}, []string{"endpoint"})
+
+	BackendHealthChecksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "collapser_backend_health_checks_total",
+		Help: "Total active health checks of backend endpoints by result (pass, fail)",
+	}, []string{"endpoint", "result"})
+
+	BackendEndpointEjected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "collapser_backend_endpoint_ejected",
+		Help: "Whether outlier detection has ejected a backend endpoint (1) or not (0)",
+	}, []string{"endpoint"})
+
+	BackendEjectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "collapser_backend_ejections_total",
+		Help: "Total outlier ejections of backend endpoints by reason (errors, latency)",
+	}, []string{"endpoint", "reason"})
+
+	BackendAttemptsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "collapser_backend_attempts_total",
+		Help: "Total backend attempts of collapsed calls, including retries",
+	})
+
+	BackendRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "collapser_backend_retries_total",
+		Help: "Total retries of collapsed backend calls by the status code that failed the previous attempt",
+	}, []string{"code"})
+
+	BackendRetriesSkippedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "collapser_backend_retries_skipped_total",
+		Help: "Total retryable failures not retried, by reason (budget, deadline)",
+	}, []string{"reason"})
+
 	BackendLatency = promauto.NewHistogram(prometheus.HistogramOpts{
 		Name:    "collapser_backend_latency_seconds",
 		Help:    "Backend backend call duration in seconds",
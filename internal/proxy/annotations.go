@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// policyOptionField is the number of the (collapser.policy) method option
+// declared in proto/collapser.proto. The option is decoded from the unknown
+// fields of MethodOptions, so the proxy needs no generated code for it.
+const policyOptionField protowire.Number = 50411
+
+// Fields of collapser.MethodPolicy.
+const (
+	policyModeField          protowire.Number = 1
+	policyTTLField           protowire.Number = 2
+	policyTimeoutField       protowire.Number = 3
+	policyKeyFieldsField     protowire.Number = 4
+	policyIgnoreFieldsField  protowire.Number = 5
+	policyNegativeCacheField protowire.Number = 6
+)
+
+// annotation is the policy a method declares in its descriptor.
+type annotation struct {
+	// idempotent is set for methods whose idempotency_level is
+	// NO_SIDE_EFFECTS or IDEMPOTENT, the only ones safe to collapse.
+	idempotent bool
+	// policy and mask are nil without a (collapser.policy) option.
+	policy *MethodPolicy
+	mask   *KeyMask
+}
+
+var errMalformedOption = errors.New("malformed (collapser.policy) option")
+
+// parseAnnotation reads the idempotency level and (collapser.policy) option
+// of m.
+func parseAnnotation(m protoreflect.MethodDescriptor) (annotation, error) {
+	opts, _ := m.Options().(*descriptorpb.MethodOptions)
+	level := opts.GetIdempotencyLevel()
+	a := annotation{
+		idempotent: level == descriptorpb.MethodOptions_NO_SIDE_EFFECTS || level == descriptorpb.MethodOptions_IDEMPOTENT,
+	}
+	if opts == nil {
+		return a, nil
+	}
+
+	// A message field that occurs more than once is merged, which on the
+	// wire is the concatenation of its occurrences.
+	var option []byte
+	found := false
+	for b := opts.ProtoReflect().GetUnknown(); len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return a, errMalformedOption
+		}
+		b = b[n:]
+		if num == policyOptionField && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return a, errMalformedOption
+			}
+			option = append(option, v...)
+			found = true
+			b = b[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return a, errMalformedOption
+		}
+		b = b[n:]
+	}
+	if !found {
+		return a, nil
+	}
+
+	policy, mask, err := decodePolicyOption(option)
+	if err != nil {
+		return a, err
+	}
+	if mask != nil {
+		if err := mask.validate(m.Input()); err != nil {
+			return a, err
+		}
+	}
+	a.policy, a.mask = policy, mask
+	return a, nil
+}
+
+// decodePolicyOption decodes a collapser.MethodPolicy message.
+func decodePolicyOption(b []byte) (*MethodPolicy, *KeyMask, error) {
+	policy := &MethodPolicy{Mode: ModeCollapseCache}
+	var mask KeyMask
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			return nil, nil, errMalformedOption
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, nil, errMalformedOption
+		}
+		b = b[n:]
+
+		var err error
+		switch num {
+		case policyModeField:
+			policy.Mode, err = ParseMode(string(v))
+		case policyTTLField:
+			policy.TTL, err = decodeDuration(v)
+		case policyTimeoutField:
+			policy.Timeout, err = decodeDuration(v)
+		case policyKeyFieldsField:
+			mask.Only = append(mask.Only, string(v))
+		case policyIgnoreFieldsField:
+			mask.Ignore = append(mask.Ignore, string(v))
+		case policyNegativeCacheField:
+			var code codes.Code
+			var ttl time.Duration
+			code, ttl, err = decodeNegativeCacheEntry(v)
+			if err == nil {
+				if policy.NegativeCache == nil {
+					policy.NegativeCache = make(map[codes.Code]time.Duration)
+				}
+				policy.NegativeCache[code] = ttl
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(mask.Only) > 0 && len(mask.Ignore) > 0 {
+		return nil, nil, errors.New("(collapser.policy) sets both key_fields and ignore_fields")
+	}
+	if len(mask.Only) == 0 && len(mask.Ignore) == 0 {
+		return policy, nil, nil
+	}
+	return policy, &mask, nil
+}
+
+// decodeNegativeCacheEntry decodes a map<string, Duration> entry keyed by
+// status code name.
+func decodeNegativeCacheEntry(b []byte) (codes.Code, time.Duration, error) {
+	var name string
+	var ttl time.Duration
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			return 0, 0, errMalformedOption
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return 0, 0, errMalformedOption
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			name = string(v)
+		case 2:
+			var err error
+			if ttl, err = decodeDuration(v); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	var code codes.Code
+	if err := code.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(name)))); err != nil {
+		return 0, 0, fmt.Errorf("negative_cache: invalid status code %q", name)
+	}
+	return code, ttl, nil
+}
+
+// decodeDuration decodes a google.protobuf.Duration message.
+func decodeDuration(b []byte) (time.Duration, error) {
+	var seconds, nanos int64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.VarintType {
+			return 0, errMalformedOption
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return 0, errMalformedOption
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			seconds = int64(v)
+		case 2:
+			nanos = int64(int32(v))
+		}
+	}
+	d := time.Duration(seconds)*time.Second + time.Duration(nanos)
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %v", d)
+	}
+	return d, nil
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func appendOptionString(b []byte, field protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendOptionDuration(b []byte, field protowire.Number, d time.Duration) []byte {
+	var duration []byte
+	duration = protowire.AppendTag(duration, 1, protowire.VarintType)
+	duration = protowire.AppendVarint(duration, uint64(d/time.Second))
+	duration = protowire.AppendTag(duration, 2, protowire.VarintType)
+	duration = protowire.AppendVarint(duration, uint64(d%time.Second))
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, duration)
+}
+
+func appendOptionNegativeCache(b []byte, code string, ttl time.Duration) []byte {
+	entry := appendOptionString(nil, 1, code)
+	entry = appendOptionDuration(entry, 2, ttl)
+	b = protowire.AppendTag(b, policyNegativeCacheField, protowire.BytesType)
+	return protowire.AppendBytes(b, entry)
+}
+
+// annotatedDescriptors builds the echo descriptors with Echo declaring level
+// and, when policy is not nil, the encoded (collapser.policy) option.
+func annotatedDescriptors(level descriptorpb.MethodOptions_IdempotencyLevel, policy []byte) (*Descriptors, error) {
+	file := echoFile()
+	opts := &descriptorpb.MethodOptions{IdempotencyLevel: level.Enum()}
+	if policy != nil {
+		b := protowire.AppendTag(nil, policyOptionField, protowire.BytesType)
+		opts.ProtoReflect().SetUnknown(protowire.AppendBytes(b, policy))
+	}
+	file.Service[0].Method[0].Options = opts
+	return NewDescriptors(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+}
+
+func TestHandler_AnnotatedPolicy(t *testing.T) {
+	option := appendOptionDuration(nil, policyTTLField, 30*time.Second)
+	option = appendOptionDuration(option, policyTimeoutField, 1500*time.Millisecond)
+	option = appendOptionString(option, policyIgnoreFieldsField, "meta.request_id")
+	option = appendOptionString(option, policyIgnoreFieldsField, "items.request_id")
+	option = appendOptionNegativeCache(option, "NOT_FOUND", 5*time.Second)
+	d, err := annotatedDescriptors(descriptorpb.MethodOptions_NO_SIDE_EFFECTS, option)
+	if err != nil {
+		t.Fatalf("failed to build descriptors: %v", err)
+	}
+
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	h := serve(t, listen(t), c, "127.0.0.1:1", WithDescriptors(d), WithPolicies(nil, MethodPolicy{Mode: ModePassthrough}))
+
+	policy := h.policy(testMethod)
+	if policy.Mode != ModeCollapseCache || policy.TTL != 30*time.Second || policy.Timeout != 1500*time.Millisecond {
+		t.Errorf("expected the annotated policy, got %+v", policy)
+	}
+	if ttl := policy.NegativeCache[codes.NotFound]; ttl != 5*time.Second {
+		t.Errorf("expected NOT_FOUND to be cached for 5s, got %v", ttl)
+	}
+	if h.generateKey(testMethod, maskedRequest("a", "r1", "t1"), nil) != h.generateKey(testMethod, maskedRequest("a", "r2", "t1"), nil) {
+		t.Error("expected the annotated key mask to ignore request IDs")
+	}
+
+	// Watch is idempotent without a policy option, Chat is not idempotent
+	// and undescribed methods use the fallback
+	for method, want := range map[string]Mode{
+		"/test.EchoService/Watch": ModeCollapseCache,
+		"/test.EchoService/Chat":  ModePassthrough,
+		"/test.OtherService/Echo": ModePassthrough,
+	} {
+		if got := h.policy(method).Mode; got != want {
+			t.Errorf("%s: expected %s, got %s", method, want, got)
+		}
+	}
+}
+
+func TestHandler_ConfiguredPolicyOverridesAnnotations(t *testing.T) {
+	d, err := annotatedDescriptors(descriptorpb.MethodOptions_IDEMPOTENCY_UNKNOWN, nil)
+	if err != nil {
+		t.Fatalf("failed to build descriptors: %v", err)
+	}
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	h := serve(t, listen(t), c, "127.0.0.1:1", WithDescriptors(d), WithPolicies([]PolicyRule{
+		{Pattern: "/test.EchoService/W*", Policy: MethodPolicy{Mode: ModeCollapseOnly}},
+	}, MethodPolicy{Mode: ModeCollapseCache}))
+
+	if mode := h.policy(testMethod).Mode; mode != ModePassthrough {
+		t.Errorf("expected a method with side effects to be passed through, got %s", mode)
+	}
+	if mode := h.policy("/test.EchoService/Watch").Mode; mode != ModeCollapseOnly {
+		t.Errorf("expected the configured rule to win, got %s", mode)
+	}
+}
+
+func TestHandler_DoesNotCollapseMethodsWithSideEffects(t *testing.T) {
+	d, err := annotatedDescriptors(descriptorpb.MethodOptions_IDEMPOTENCY_UNKNOWN, nil)
+	if err != nil {
+		t.Fatalf("failed to build descriptors: %v", err)
+	}
+	backend := startBackend(t, 0)
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: time.Minute,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     time.Second,
+	})
+	lis := listen(t)
+	serve(t, lis, c, backend.addr, WithDescriptors(d))
+	conn := dial(t, lis.Addr().String())
+
+	for i := 0; i < 3; i++ {
+		if _, err := invoke(t.Context(), conn, string(appendName(nil, "a"))); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls := backend.calls.Load(); calls != 3 {
+		t.Errorf("expected 3 backend calls, got %d", calls)
+	}
+}
+
+func TestDescriptors_RejectsInvalidAnnotations(t *testing.T) {
+	for name, option := range map[string][]byte{
+		"mode":         appendOptionString(nil, policyModeField, "collapse"),
+		"field path":   appendOptionString(nil, policyKeyFieldsField, "meta.missing"),
+		"exclusive":    appendOptionString(appendOptionString(nil, policyKeyFieldsField, "name"), policyIgnoreFieldsField, "meta"),
+		"status code":  appendOptionNegativeCache(nil, "NOPE", time.Second),
+		"wire format":  {0xff},
+		"wrong type":   protowire.AppendVarint(protowire.AppendTag(nil, policyTTLField, protowire.VarintType), 1),
+		"bad duration": appendOptionDuration(nil, policyTTLField, -time.Second),
+	} {
+		if _, err := annotatedDescriptors(descriptorpb.MethodOptions_NO_SIDE_EFFECTS, option); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
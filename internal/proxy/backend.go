@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+)
+
+// BackendConfig configures the pooled backend client.
+type BackendConfig struct {
+	// PoolSize is the number of ClientConns per address requests are spread
+	// over. Each is a single HTTP/2 connection, so more than one helps once a
+	// backend limits concurrent streams per connection. Zero uses
+	// DefaultPoolSize.
+	PoolSize int
+
+	// KeepaliveTime is how long a connection may be idle before it is
+	// pinged, and KeepaliveTimeout how long to wait for the ping ack before
+	// closing it. Zero disables keepalive pings.
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+
+	// TLS enables TLS to the backend. Nil uses plaintext.
+	TLS *tls.Config
+
+	// DialOptions are appended to the options used for every connection.
+	DialOptions []grpc.DialOption
+
+	// LoadBalancing spreads calls over the backend's addresses. Empty uses
+	// RoundRobin.
+	LoadBalancing LoadBalancing
+	// HealthCheck takes addresses failing grpc.health.v1 checks out of
+	// rotation.
+	HealthCheck HealthCheck
+	// OutlierDetection ejects addresses whose calls keep failing or are
+	// much slower than the others.
+	OutlierDetection OutlierDetection
+}
+
+// DefaultPoolSize is used when BackendConfig.PoolSize is not set.
+const DefaultPoolSize = 4
+
+// Backend is a long-lived client for a backend service served at one or
+// more addresses. Calls are balanced over the addresses, then spread
+// round-robin over a fixed pool of connections to each.
+type Backend struct {
+	endpoints []*endpoint
+	lb        LoadBalancing
+	next      atomic.Uint64
+
+	outlier OutlierDetection
+	ejectMu sync.Mutex
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewBackend creates the connection pool for addrs and starts connecting in
+// the background, so the first request does not pay for the handshake.
+func NewBackend(addrs []string, cfg BackendConfig) (*Backend, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("backend has no addresses")
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = DefaultPoolSize
+	}
+	lb, err := ParseLoadBalancing(string(cfg.LoadBalancing))
+	if err != nil {
+		return nil, err
+	}
+
+	creds := insecure.NewCredentials()
+	if cfg.TLS != nil {
+		creds = newClientCredentials(cfg.TLS)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if cfg.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    cfg.KeepaliveTime,
+			Timeout: cfg.KeepaliveTimeout,
+		}))
+	}
+	opts = append(opts, cfg.DialOptions...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Backend{lb: lb, cancel: cancel}
+	for _, addr := range addrs {
+		e := &endpoint{addr: addr}
+		e.healthy.Store(true)
+		b.endpoints = append(b.endpoints, e)
+		for i := 0; i < cfg.PoolSize; i++ {
+			conn, err := grpc.NewClient(addr, opts...)
+			if err != nil {
+				b.Close()
+				return nil, err
+			}
+			e.conns = append(e.conns, conn)
+
+			b.wg.Add(1)
+			go b.watchState(ctx, conn)
+			conn.Connect()
+		}
+	}
+	if cfg.HealthCheck.Interval > 0 {
+		for _, e := range b.endpoints {
+			b.wg.Add(1)
+			go b.checkHealth(ctx, e, cfg.HealthCheck)
+		}
+	}
+	// With a single address there is no peer to fail over to
+	if cfg.OutlierDetection.enabled() && len(b.endpoints) > 1 {
+		b.outlier = cfg.OutlierDetection.withDefaults()
+		b.wg.Add(1)
+		go b.detectOutliers(ctx)
+	}
+	return b, nil
+}
+
+// Conn returns a connection to the next endpoint in rotation.
+func (b *Backend) Conn() *grpc.ClientConn {
+	return b.pick(context.Background()).conn()
+}
+
+// rawCall makes a call carry RawMessage frames. It is set per call rather
+// than on the connections, which are shared with typed clients such as
+// server reflection.
+var rawCall = grpc.ForceCodecV2(RawCodec{})
+
+// Invoke sends a unary request and returns the raw response payload.
+func (b *Backend) Invoke(ctx context.Context, method string, data []byte, opts ...grpc.CallOption) ([]byte, error) {
+	e := b.pick(ctx)
+	defer e.acquire()()
+
+	var out RawMessage
+	opts = append([]grpc.CallOption{rawCall}, opts...)
+	start := time.Now()
+	err := e.conn().Invoke(ctx, method, &RawMessage{Data: data}, &out, opts...)
+	b.observe(ctx, e, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// NewStream opens a stream of RawMessage frames for a call of any kind on
+// the next endpoint. The call counts as in flight until ctx is done or a
+// receive fails.
+func (b *Backend) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	e := b.pick(ctx)
+	release := e.acquire()
+
+	opts = append([]grpc.CallOption{rawCall}, opts...)
+	stream, err := e.conn().NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	context.AfterFunc(ctx, release)
+	return &countedStream{ClientStream: stream, release: release}, nil
+}
+
+// OpenStream starts a server-streaming call with a single request message.
+func (b *Backend) OpenStream(ctx context.Context, method string, data []byte, opts ...grpc.CallOption) (collapser.StreamSource, error) {
+	stream, err := b.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&RawMessage{Data: data}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &backendStream{stream: stream}, nil
+}
+
+// Close closes every connection of the pool.
+func (b *Backend) Close() error {
+	// Stop health checks first so closing connections does not fail them
+	b.cancel()
+	var errs []error
+	for _, e := range b.endpoints {
+		for _, conn := range e.conns {
+			errs = append(errs, conn.Close())
+		}
+	}
+	b.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// watchState reports the connectivity state of conn until it is closed.
+func (b *Backend) watchState(ctx context.Context, conn *grpc.ClientConn) {
+	defer b.wg.Done()
+
+	state := conn.GetState()
+	monitoring.BackendConnections.WithLabelValues(state.String()).Inc()
+	defer func() {
+		monitoring.BackendConnections.WithLabelValues(state.String()).Dec()
+	}()
+
+	for state != connectivity.Shutdown {
+		if !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+		monitoring.BackendConnections.WithLabelValues(state.String()).Dec()
+		state = conn.GetState()
+		monitoring.BackendConnections.WithLabelValues(state.String()).Inc()
+		monitoring.BackendConnStateChangesTotal.WithLabelValues(state.String()).Inc()
+	}
+}
+
+// backendStream reads the responses of a server-streaming backend call.
+type backendStream struct {
+	stream grpc.ClientStream
+}
+
+func (s *backendStream) Recv() ([]byte, error) {
+	var out RawMessage
+	if err := s.stream.RecvMsg(&out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+func (s *backendStream) Header() (metadata.MD, error) {
+	return s.stream.Header()
+}
+
+func (s *backendStream) Trailer() metadata.MD {
+	return s.stream.Trailer()
+}
+
+// countedStream releases its endpoint's in-flight count once the call ends.
+type countedStream struct {
+	grpc.ClientStream
+	release func()
+}
+
+func (s *countedStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.release()
+	}
+	return err
+}
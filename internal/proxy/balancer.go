@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// LoadBalancing chooses which endpoint of a backend serves a call.
+type LoadBalancing string
+
+const (
+	// RoundRobin takes endpoints in turn.
+	RoundRobin LoadBalancing = "round-robin"
+	// LeastRequest picks the endpoint with the fewest calls in flight.
+	LeastRequest LoadBalancing = "least-request"
+	// ConsistentHash sends calls with the same collapse key to the same
+	// endpoint, so each endpoint's own caches see the same keys. Calls
+	// without a key are taken round-robin.
+	ConsistentHash LoadBalancing = "consistent-hash"
+)
+
+// ParseLoadBalancing validates a load balancing policy name. An empty name
+// is RoundRobin.
+func ParseLoadBalancing(s string) (LoadBalancing, error) {
+	switch lb := LoadBalancing(s); lb {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, LeastRequest, ConsistentHash:
+		return lb, nil
+	}
+	return "", fmt.Errorf("invalid load balancing policy %q (want round-robin, least-request or consistent-hash)", s)
+}
+
+// endpoint is one backend address and its connections.
+type endpoint struct {
+	addr  string
+	conns []*grpc.ClientConn
+	next  atomic.Uint64
+
+	// inflight counts calls in progress, for LeastRequest.
+	inflight atomic.Int64
+	// healthy is cleared by failing health checks.
+	healthy atomic.Bool
+
+	// Outlier detection state: consecutive server failures, latency of the
+	// calls completed this interval, and the current ejection, in Unix
+	// nanoseconds, with the number of recent ejections that lengthen it.
+	failures     atomic.Int64
+	latencyNanos atomic.Int64
+	latencyCalls atomic.Int64
+	ejectedUntil atomic.Int64
+	ejections    atomic.Int64
+}
+
+// conn returns the next connection to the endpoint.
+func (e *endpoint) conn() *grpc.ClientConn {
+	return e.conns[e.next.Add(1)%uint64(len(e.conns))]
+}
+
+// ejected reports whether outlier detection has taken e out of rotation.
+func (e *endpoint) ejected(now time.Time) bool {
+	return now.UnixNano() < e.ejectedUntil.Load()
+}
+
+// acquire counts a call in flight until the returned func is called.
+func (e *endpoint) acquire() func() {
+	e.inflight.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { e.inflight.Add(-1) })
+	}
+}
+
+type hashKeyContextKey struct{}
+
+// withHashKey attaches the collapse key that ConsistentHash balances on.
+func withHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyContextKey{}, key)
+}
+
+func hashKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKeyContextKey{}).(string)
+	return key, ok
+}
+
+// pick chooses the endpoint for a call. Unhealthy and ejected endpoints are
+// skipped unless that leaves none, in which case all of them are candidates
+// rather than failing every call.
+func (b *Backend) pick(ctx context.Context) *endpoint {
+	now := time.Now()
+	candidates := make([]*endpoint, 0, len(b.endpoints))
+	for _, e := range b.endpoints {
+		if e.healthy.Load() && !e.ejected(now) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = b.endpoints
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	start := b.next.Add(1)
+	switch b.lb {
+	case LeastRequest:
+		// Scan from the round-robin position so ties are spread evenly
+		best := candidates[start%uint64(len(candidates))]
+		for i := range candidates {
+			e := candidates[(start+uint64(i))%uint64(len(candidates))]
+			if e.inflight.Load() < best.inflight.Load() {
+				best = e
+			}
+		}
+		return best
+	case ConsistentHash:
+		if key, ok := hashKeyFromContext(ctx); ok {
+			return rendezvous(candidates, key)
+		}
+	}
+	return candidates[start%uint64(len(candidates))]
+}
+
+// rendezvous returns the endpoint with the highest hash of key and its
+// address. Removing an endpoint only moves the keys it held.
+func rendezvous(endpoints []*endpoint, key string) *endpoint {
+	var best *endpoint
+	var bestScore uint64
+	for _, e := range endpoints {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(e.addr))
+		if score := mix64(h.Sum64()); best == nil || score > bestScore {
+			best, bestScore = e, score
+		}
+	}
+	return best
+}
+
+// mix64 is the splitmix64 finalizer. FNV alone barely changes its high bits
+// between inputs differing in their last bytes, which would skew the scores.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testEndpoints builds a Backend of connection-less endpoints to test pick.
+func testEndpoints(lb LoadBalancing, addrs ...string) *Backend {
+	b := &Backend{lb: lb}
+	for _, addr := range addrs {
+		e := &endpoint{addr: addr}
+		e.healthy.Store(true)
+		b.endpoints = append(b.endpoints, e)
+	}
+	return b
+}
+
+func TestBackend_PickRoundRobin(t *testing.T) {
+	b := testEndpoints(RoundRobin, "a", "b", "c")
+	b.endpoints[1].healthy.Store(false)
+
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[b.pick(context.Background()).addr]++
+	}
+	if counts["a"] != 5 || counts["c"] != 5 || counts["b"] != 0 {
+		t.Errorf("expected calls spread over healthy endpoints, got %v", counts)
+	}
+
+	// With every endpoint unhealthy, all are used rather than none
+	for _, e := range b.endpoints {
+		e.healthy.Store(false)
+	}
+	counts = make(map[string]int)
+	for i := 0; i < 9; i++ {
+		counts[b.pick(context.Background()).addr]++
+	}
+	if len(counts) != 3 {
+		t.Errorf("expected every endpoint to be used when none is healthy, got %v", counts)
+	}
+}
+
+func TestBackend_PickLeastRequest(t *testing.T) {
+	b := testEndpoints(LeastRequest, "a", "b", "c")
+	b.endpoints[0].inflight.Store(3)
+	b.endpoints[1].inflight.Store(1)
+	b.endpoints[2].inflight.Store(2)
+	for i := 0; i < 5; i++ {
+		if e := b.pick(context.Background()); e.addr != "b" {
+			t.Fatalf("expected the least loaded endpoint, got %s", e.addr)
+		}
+	}
+
+	release := b.endpoints[1].acquire()
+	b.endpoints[1].acquire()
+	if e := b.pick(context.Background()); e.addr != "c" {
+		t.Errorf("expected in-flight calls to be counted, got %s", e.addr)
+	}
+	release()
+	release()
+	if n := b.endpoints[1].inflight.Load(); n != 2 {
+		t.Errorf("expected release to be idempotent, got %d in flight", n)
+	}
+}
+
+func TestBackend_PickConsistentHash(t *testing.T) {
+	b := testEndpoints(ConsistentHash, "a", "b", "c", "d")
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("/pkg.Service/Method:%d", i)
+		ctx := withHashKey(context.Background(), key)
+		owner := b.pick(ctx).addr
+		if again := b.pick(ctx).addr; again != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, again)
+		}
+		owners[key] = owner
+		counts[owner]++
+	}
+	for _, e := range b.endpoints {
+		if counts[e.addr] < 150 {
+			t.Errorf("expected keys spread evenly, got %v", counts)
+			break
+		}
+	}
+
+	// Only the keys of an ejected endpoint move
+	b.endpoints[0].healthy.Store(false)
+	for key, owner := range owners {
+		now := b.pick(withHashKey(context.Background(), key)).addr
+		if owner != "a" && now != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, now)
+		}
+		if now == "a" {
+			t.Fatalf("key %s still on the unhealthy endpoint", key)
+		}
+	}
+}
+
+// startHealthBackend is startBackend with a grpc.health.v1 service whose
+// status the test controls.
+func startHealthBackend(t *testing.T) (*testBackend, *health.Server) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	b := &testBackend{addr: lis.Addr().String()}
+	s := grpc.NewServer(grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		in := &RawMessage{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		b.calls.Add(1)
+		return stream.SendMsg(&RawMessage{Data: in.Data})
+	}))
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return b, hs
+}
+
+func TestBackend_HealthChecks(t *testing.T) {
+	sick, sickHealth := startHealthBackend(t)
+	well, _ := startHealthBackend(t)
+	b, err := NewBackend([]string{sick.addr, well.addr}, BackendConfig{
+		PoolSize:    1,
+		HealthCheck: HealthCheck{Interval: 10 * time.Millisecond, UnhealthyThreshold: 2},
+	})
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+	defer b.Close()
+
+	waitHealthy := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for b.endpoints[0].healthy.Load() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("endpoint did not become healthy=%v", want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	sickHealth.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitHealthy(false)
+	for i := 0; i < 10; i++ {
+		if _, err := b.Invoke(context.Background(), testMethod, []byte("hello")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if sick.calls.Load() != 0 || well.calls.Load() != 10 {
+		t.Errorf("expected every call on the healthy endpoint, got %d and %d", sick.calls.Load(), well.calls.Load())
+	}
+
+	sickHealth.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	waitHealthy(true)
+}
+
+func TestHandler_ConsistentHashByCollapseKey(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]map[string]bool) // payload -> backend addresses
+	start := func() string {
+		lis := listen(t)
+		addr := lis.Addr().String()
+		s := grpc.NewServer(grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+			in := &RawMessage{}
+			if err := stream.RecvMsg(in); err != nil {
+				return err
+			}
+			mu.Lock()
+			if seen[string(in.Data)] == nil {
+				seen[string(in.Data)] = make(map[string]bool)
+			}
+			seen[string(in.Data)][addr] = true
+			mu.Unlock()
+			return stream.SendMsg(in)
+		}))
+		go s.Serve(lis)
+		t.Cleanup(s.Stop)
+		return addr
+	}
+
+	// Without a result cache every call reaches a backend
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	lis := listen(t)
+	serve(t, lis, c, "", WithRoutes([]Cluster{{
+		Name:      "echo",
+		Addresses: []string{start(), start(), start()},
+		Backend:   BackendConfig{PoolSize: 1, LoadBalancing: ConsistentHash},
+	}}, nil, "echo"))
+	conn := dial(t, lis.Addr().String())
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20; i++ {
+			if _, err := invoke(context.Background(), conn, fmt.Sprintf("req-%d", i)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for data, addrs := range seen {
+		if len(addrs) != 1 {
+			t.Errorf("expected %s to always reach the same endpoint, got %v", data, addrs)
+		}
+	}
+}
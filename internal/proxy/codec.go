@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/metadata"
+)
+
+var protoCodec = encoding.GetCodecV2(proto.Name)
+
+// RawMessage is a message frame carried verbatim by RawCodec.
+type RawMessage struct {
+	Data []byte
+}
+
+// RawCodec forwards RawMessage frames byte for byte, whatever their
+// content-subtype, so payloads are never decoded or re-encoded. Other values
+// go through the proto codec, so typed services such as health checks can
+// share a server or connection with it. Servers calling Handle must force it
+// with grpc.ForceServerCodecV2; Serve does so.
+type RawCodec struct{}
+
+func (RawCodec) Marshal(v any) (mem.BufferSlice, error) {
+	msg, ok := v.(*RawMessage)
+	if !ok {
+		return protoCodec.Marshal(v)
+	}
+	return mem.BufferSlice{mem.SliceBuffer(msg.Data)}, nil
+}
+
+func (RawCodec) Unmarshal(data mem.BufferSlice, v any) error {
+	msg, ok := v.(*RawMessage)
+	if !ok {
+		return protoCodec.Unmarshal(data, v)
+	}
+	// Materialize copies, as data is released once Unmarshal returns
+	msg.Data = data.Materialize()
+	return nil
+}
+
+// Name is empty so calls made without grpc.CallContentSubtype keep the
+// plain application/grpc content type rather than naming a codec.
+func (RawCodec) Name() string { return "" }
+
+// contentSubtype returns the lowercase content-subtype of an incoming call,
+// e.g. "json" for application/grpc+json and "" for application/grpc.
+func contentSubtype(md metadata.MD) string {
+	values := md.Get("content-type")
+	if len(values) == 0 {
+		return ""
+	}
+	rest, ok := strings.CutPrefix(strings.ToLower(values[0]), "application/grpc")
+	if !ok || rest == "" {
+		return ""
+	}
+	return rest[1:]
+}
+
+// isProtoSubtype reports whether payloads of subtype are binary protobuf.
+func isProtoSubtype(subtype string) bool {
+	return subtype == "" || subtype == "proto"
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestHandler_PreservesContentSubtype(t *testing.T) {
+	var mu sync.Mutex
+	var contentTypes []string
+	backendLis := listen(t)
+	s := grpc.NewServer(grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		in := &RawMessage{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		mu.Lock()
+		contentTypes = append(contentTypes, md.Get("content-type")...)
+		mu.Unlock()
+		return stream.SendMsg(&RawMessage{Data: in.Data})
+	}))
+	go s.Serve(backendLis)
+	t.Cleanup(s.Stop)
+
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: time.Minute,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     time.Second,
+	})
+	lis := listen(t)
+	serve(t, lis, c, backendLis.Addr().String())
+	conn := dial(t, lis.Addr().String())
+
+	call := func(data string, opts ...grpc.CallOption) metadata.MD {
+		t.Helper()
+		var header metadata.MD
+		var out RawMessage
+		opts = append(opts, grpc.Header(&header))
+		if err := conn.Invoke(t.Context(), testMethod, &RawMessage{Data: []byte(data)}, &out, opts...); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(out.Data) != data {
+			t.Errorf("expected %q verbatim, got %q", data, out.Data)
+		}
+		return header
+	}
+
+	const body = `{"name":"a"}`
+	header := call(body, grpc.CallContentSubtype("json"))
+	if got := header.Get("content-type"); len(got) != 1 || got[0] != "application/grpc+json" {
+		t.Errorf("expected an application/grpc+json response, got %v", got)
+	}
+	call(body, grpc.CallContentSubtype("json"))
+	call(body)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"application/grpc+json", "application/grpc"}
+	if len(contentTypes) != len(want) {
+		t.Fatalf("expected backend calls with %v, got %v", want, contentTypes)
+	}
+	for i := range want {
+		if contentTypes[i] != want[i] {
+			t.Errorf("call %d: expected %s, got %s", i, want[i], contentTypes[i])
+		}
+	}
+}
+
+func TestHandler_KeysIncludeContentSubtype(t *testing.T) {
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	h := serve(t, listen(t), c, "127.0.0.1:1", WithDescriptors(echoDescriptors(t)))
+
+	contentType := func(value string) metadata.MD {
+		return metadata.Pairs("content-type", value)
+	}
+	data := appendCount(appendName(nil, "a"), 3)
+	key := h.generateKey(testMethod, data, contentType("application/grpc"))
+	if h.generateKey(testMethod, data, contentType("application/grpc+proto")) != key {
+		t.Error("expected application/grpc and application/grpc+proto to share the key")
+	}
+	if h.generateKey(testMethod, data, contentType("application/grpc+json")) == key {
+		t.Error("expected the content-subtype to be part of the key")
+	}
+
+	// Only protobuf payloads are canonicalized
+	reordered := appendName(appendCount(nil, 3), "a")
+	if h.generateKey(testMethod, reordered, contentType("application/grpc")) != key {
+		t.Error("expected protobuf payloads to be canonicalized")
+	}
+	if h.generateKey(testMethod, reordered, contentType("application/grpc+json")) == h.generateKey(testMethod, data, contentType("application/grpc+json")) {
+		t.Error("expected payloads of other subtypes to be keyed on their raw bytes")
+	}
+}
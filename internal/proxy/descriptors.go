@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/logger"
+	"go.uber.org/zap"
+
+	"google.golang.org/grpc"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Descriptors maps full method names (e.g. /pkg.Service/Method) to their
+// descriptors, so requests can be decoded without generated code.
+type Descriptors struct {
+	files       *protoregistry.Files
+	methods     map[string]protoreflect.MethodDescriptor
+	annotations map[string]annotation
+}
+
+// NewDescriptors indexes every service method in set, along with the
+// idempotency level and (collapser.policy) option each declares.
+func NewDescriptors(set *descriptorpb.FileDescriptorSet) (*Descriptors, error) {
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	d := &Descriptors{
+		files:       files,
+		methods:     make(map[string]protoreflect.MethodDescriptor),
+		annotations: make(map[string]annotation),
+	}
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			methods := services.Get(i).Methods()
+			for j := 0; j < methods.Len(); j++ {
+				m := methods.Get(j)
+				name := "/" + string(m.Parent().FullName()) + "/" + string(m.Name())
+				a, aerr := parseAnnotation(m)
+				if aerr != nil {
+					err = fmt.Errorf("%s: %w", name, aerr)
+					return false
+				}
+				d.methods[name] = m
+				d.annotations[name] = a
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// LoadDescriptorSet reads a binary FileDescriptorSet, as written by
+// protoc --descriptor_set_out --include_imports.
+func LoadDescriptorSet(path string) (*Descriptors, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("parse descriptor set %s: %w", path, err)
+	}
+	return NewDescriptors(&set)
+}
+
+// LoadReflection fetches the descriptors of every service conn exposes
+// through the gRPC server reflection service.
+func LoadReflection(ctx context.Context, conn grpc.ClientConnInterface) (*Descriptors, error) {
+	files, err := reflectFiles(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return NewDescriptors(&descriptorpb.FileDescriptorSet{File: files})
+}
+
+// reflectFiles fetches the files describing every service conn exposes, and
+// their dependencies.
+func reflectFiles(ctx context.Context, conn grpc.ClientConnInterface) ([]*descriptorpb.FileDescriptorProto, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	roundTrip := func(req *reflectionpb.ServerReflectionRequest) (*reflectionpb.ServerReflectionResponse, error) {
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, fmt.Errorf("reflection: %s", e.GetErrorMessage())
+		}
+		return resp, nil
+	}
+
+	resp, err := roundTrip(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	// add records the files in resp and returns dependencies not seen yet
+	add := func(resp *reflectionpb.ServerReflectionResponse) ([]string, error) {
+		var missing []string
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			file := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, file); err != nil {
+				return nil, err
+			}
+			files[file.GetName()] = file
+		}
+		for _, file := range files {
+			for _, dep := range file.GetDependency() {
+				if _, ok := files[dep]; !ok {
+					missing = append(missing, dep)
+				}
+			}
+		}
+		return missing, nil
+	}
+
+	var missing []string
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		if strings.HasPrefix(service.GetName(), "grpc.reflection.") {
+			continue
+		}
+		resp, err := roundTrip(&reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service.GetName()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if missing, err = add(resp); err != nil {
+			return nil, err
+		}
+	}
+	requested := make(map[string]bool)
+	for len(missing) > 0 {
+		name := missing[0]
+		if requested[name] {
+			return nil, fmt.Errorf("reflection: server did not return %s", name)
+		}
+		requested[name] = true
+		resp, err := roundTrip(&reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_FileByFilename{FileByFilename: name},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if missing, err = add(resp); err != nil {
+			return nil, err
+		}
+	}
+
+	var set []*descriptorpb.FileDescriptorProto
+	for _, file := range files {
+		set = append(set, file)
+	}
+	return set, nil
+}
+
+// Method returns the descriptor of a full method name.
+func (d *Descriptors) Method(name string) (protoreflect.MethodDescriptor, bool) {
+	if d == nil {
+		return nil, false
+	}
+	m, ok := d.methods[name]
+	return m, ok
+}
+
+// annotation returns what a described method declares about itself.
+func (d *Descriptors) annotation(name string) (annotation, bool) {
+	if d == nil {
+		return annotation{}, false
+	}
+	a, ok := d.annotations[name]
+	return a, ok
+}
+
+// Len returns the number of known methods.
+func (d *Descriptors) Len() int {
+	return len(d.methods)
+}
+
+// methodKind says how Handle serves a method.
+type methodKind int
+
+const (
+	unaryMethod methodKind = iota
+	serverStreamingMethod
+	passthroughMethod
+)
+
+// methodKind classifies method from the configured method lists, then its
+// descriptor. Undescribed methods are assumed to be unary.
+func (h *Handler) methodKind(method string) methodKind {
+	switch {
+	case h.passthroughMethods[method]:
+		return passthroughMethod
+	case h.streams != nil && h.streamingMethods[method]:
+		return serverStreamingMethod
+	}
+
+	desc, ok := h.descriptors.Load().Method(method)
+	switch {
+	case !ok:
+		return unaryMethod
+	case desc.IsStreamingClient():
+		return passthroughMethod
+	case desc.IsStreamingServer():
+		if h.streams == nil {
+			return passthroughMethod
+		}
+		return serverStreamingMethod
+	}
+	return unaryMethod
+}
+
+// reflectionRetryInterval is how long loadReflection waits between attempts.
+var reflectionRetryInterval = 5 * time.Second
+
+// loadReflection fetches descriptors from a cluster until it succeeds or
+// the handler is closed, and merges them with those of other clusters.
+func (h *Handler) loadReflection(c *cluster) {
+	defer h.wg.Done()
+
+	for {
+		ctx, cancel := context.WithTimeout(h.closing, reflectionRetryInterval)
+		files, err := reflectFiles(ctx, c.backend.Conn())
+		cancel()
+		if err == nil {
+			err = h.addReflected(files)
+		}
+		if err == nil {
+			logger.Info("loaded descriptors via server reflection",
+				zap.String("cluster", c.name),
+				zap.Int("methods", h.descriptors.Load().Len()))
+			return
+		}
+		logger.Warn("failed to load descriptors via server reflection", zap.String("cluster", c.name), zap.Error(err))
+
+		select {
+		case <-time.After(reflectionRetryInterval):
+		case <-h.closing.Done():
+			return
+		}
+	}
+}
+
+// addReflected merges files into the descriptors loaded so far.
+func (h *Handler) addReflected(files []*descriptorpb.FileDescriptorProto) error {
+	h.reflectMu.Lock()
+	defer h.reflectMu.Unlock()
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, file := range h.reflected {
+		set.File = append(set.File, file)
+	}
+	for _, file := range files {
+		// Clusters share well-known and common files; keep the first copy
+		if _, ok := h.reflected[file.GetName()]; !ok {
+			set.File = append(set.File, file)
+		}
+	}
+	d, err := NewDescriptors(set)
+	if err != nil {
+		return err
+	}
+	if err := h.validateKeyMasks(d); err != nil {
+		logger.Warn("key mask does not match reflected descriptors", zap.Error(err))
+	}
+	for _, file := range set.File {
+		h.reflected[file.GetName()] = file
+	}
+	h.descriptors.Store(d)
+	return nil
+}
+
+// canonicalize re-encodes a request deterministically: fields in number
+// order, map entries sorted, unknown fields and explicitly encoded defaults
+// of implicit-presence fields dropped. Semantically identical requests
+// therefore produce identical bytes. mask, if set, is applied first.
+func canonicalize(desc protoreflect.MessageDescriptor, data []byte, mask *KeyMask) ([]byte, error) {
+	msg := dynamicpb.NewMessage(desc)
+	if err := (proto.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	var canonical proto.Message = msg
+	if mask != nil {
+		canonical = mask.apply(msg).Interface()
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(canonical)
+}
+
+// validateKeyMasks checks the configured key masks of described methods
+// against d.
+func (h *Handler) validateKeyMasks(d *Descriptors) error {
+	for method, desc := range d.methods {
+		mask := h.configuredKeyMask(method)
+		if mask == nil {
+			continue
+		}
+		if err := mask.validate(desc.Input()); err != nil {
+			return fmt.Errorf("%s: %w", method, err)
+		}
+	}
+	return nil
+}
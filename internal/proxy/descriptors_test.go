@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// echoFile describes test.EchoService with a unary, a server-streaming and a
+// bidi method, all taking test.EchoRequest{name = 1, count = 2, meta = 3,
+// items = 4}, where meta and the repeated items are test.Meta{request_id = 1,
+// trace = 2}. Echo and Watch have no side effects.
+func echoFile() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+			JsonName: proto.String(name),
+		}
+	}
+	method := func(name string, clientStreaming, serverStreaming bool) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(name),
+			InputType:       proto.String(".test.EchoRequest"),
+			OutputType:      proto.String(".test.EchoRequest"),
+			ClientStreaming: proto.Bool(clientStreaming),
+			ServerStreaming: proto.Bool(serverStreaming),
+		}
+	}
+	noSideEffects := func(m *descriptorpb.MethodDescriptorProto) *descriptorpb.MethodDescriptorProto {
+		m.Options = &descriptorpb.MethodOptions{IdempotencyLevel: descriptorpb.MethodOptions_NO_SIDE_EFFECTS.Enum()}
+		return m
+	}
+	meta := field("meta", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	meta.TypeName = proto.String(".test.Meta")
+	items := field("items", 4, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	items.TypeName = proto.String(".test.Meta")
+	items.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test/echo.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("EchoRequest"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+				meta,
+				items,
+			},
+		}, {
+			Name: proto.String("Meta"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("request_id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("trace", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("EchoService"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				noSideEffects(method("Echo", false, false)),
+				noSideEffects(method("Watch", false, true)),
+				method("Chat", true, true),
+			},
+		}},
+	}
+}
+
+func echoDescriptors(t testing.TB) *Descriptors {
+	t.Helper()
+	d, err := NewDescriptors(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{echoFile()}})
+	if err != nil {
+		t.Fatalf("failed to build descriptors: %v", err)
+	}
+	return d
+}
+
+func appendName(b []byte, name string) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendString(b, name)
+}
+
+func appendCount(b []byte, count uint64) []byte {
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, count)
+}
+
+func TestHandler_CanonicalKeys(t *testing.T) {
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	h := serve(t, listen(t), c, "127.0.0.1:1", WithDescriptors(echoDescriptors(t)))
+
+	base := h.generateKey(testMethod, appendCount(appendName(nil, "a"), 3), nil)
+	unknown := protowire.AppendTag(appendCount(appendName(nil, "a"), 3), 9, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 1)
+
+	for name, data := range map[string][]byte{
+		"reordered":      appendName(appendCount(nil, 3), "a"),
+		"unknown field":  unknown,
+		"repeated field": appendCount(appendName(appendCount(nil, 1), "a"), 3),
+	} {
+		if key := h.generateKey(testMethod, data, nil); key != base {
+			t.Errorf("%s: expected the canonical key", name)
+		}
+	}
+
+	// Explicitly encoded defaults are the same request as omitted ones
+	if h.generateKey(testMethod, appendCount(appendName(nil, "a"), 0), nil) != h.generateKey(testMethod, appendName(nil, "a"), nil) {
+		t.Error("expected explicit default to share the key")
+	}
+	if h.generateKey(testMethod, appendCount(appendName(nil, "b"), 3), nil) == base {
+		t.Error("expected different requests to have different keys")
+	}
+
+	// Undescribed methods fall back to the raw bytes
+	other := "/test.OtherService/Echo"
+	if h.generateKey(other, appendName(appendCount(nil, 3), "a"), nil) == h.generateKey(other, appendCount(appendName(nil, "a"), 3), nil) {
+		t.Error("expected raw keys for undescribed methods")
+	}
+}
+
+func TestDescriptors_LoadDescriptorSet(t *testing.T) {
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{echoFile()}})
+	if err != nil {
+		t.Fatalf("failed to marshal descriptor set: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "echo.pb")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatalf("failed to write descriptor set: %v", err)
+	}
+
+	d, err := LoadDescriptorSet(path)
+	if err != nil {
+		t.Fatalf("failed to load descriptor set: %v", err)
+	}
+	if d.Len() != 3 {
+		t.Errorf("expected 3 methods, got %d", d.Len())
+	}
+	if m, ok := d.Method("/test.EchoService/Watch"); !ok || !m.IsStreamingServer() {
+		t.Error("expected Watch to be a server-streaming method")
+	}
+}
+
+// echoServices advertises test.EchoService to the reflection service.
+type echoServices struct{}
+
+func (echoServices) GetServiceInfo() map[string]grpc.ServiceInfo {
+	return map[string]grpc.ServiceInfo{"test.EchoService": {}}
+}
+
+func TestDescriptors_LoadReflection(t *testing.T) {
+	files := echoDescriptors(t).files
+
+	lis := listen(t)
+	s := grpc.NewServer()
+	reflectionpb.RegisterServerReflectionServer(s, reflection.NewServerV1(reflection.ServerOptions{
+		Services:           echoServices{},
+		DescriptorResolver: files,
+	}))
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	h := serve(t, listen(t), c, lis.Addr().String(), WithReflection())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.descriptors.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("descriptors were not loaded via reflection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for method, want := range map[string]methodKind{
+		"/test.EchoService/Echo":  unaryMethod,
+		"/test.EchoService/Watch": passthroughMethod, // no StreamGroup configured
+		"/test.EchoService/Chat":  passthroughMethod,
+		"/test.Unknown/Method":    unaryMethod,
+	} {
+		if got := h.methodKind(method); got != want {
+			t.Errorf("%s: expected kind %d, got %d", method, want, got)
+		}
+	}
+}
+
+func TestHandler_CollapsesCanonicallyEqualRequests(t *testing.T) {
+	backend := startBackend(t, 0)
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: time.Minute,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     time.Second,
+	})
+	lis := listen(t)
+	serve(t, lis, c, backend.addr, WithDescriptors(echoDescriptors(t)))
+	conn := dial(t, lis.Addr().String())
+
+	for _, data := range [][]byte{
+		appendCount(appendName(nil, "a"), 3),
+		appendName(appendCount(nil, 3), "a"),
+	} {
+		if _, err := invoke(t.Context(), conn, string(data)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 backend call, got %d", calls)
+	}
+}
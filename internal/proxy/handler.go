@@ -3,30 +3,270 @@ package proxy
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
+// StaleTrailer is set on responses served from expired cached data.
+const StaleTrailer = "x-collapser-stale"
+
 type Handler struct {
-	backendAddr string
-	collapser   *collapser.Collapser
+	backendCfg BackendConfig
+	collapser  *collapser.Collapser
+	serverTLS  *tls.Config
+	mdFilter   MetadataFilter
+
+	// keyMetadata are the metadata keys, sorted, that are part of the
+	// collapse key. credentialMetadata are keys that must be listed there
+	// for requests carrying them to be collapsed.
+	keyMetadata        []string
+	credentialMetadata []string
+
+	streams          *collapser.StreamGroup
+	streamingMethods map[string]bool
+
+	passthroughMethods map[string]bool
+
+	// descriptors, when known, classify methods and canonicalize keys.
+	descriptors atomic.Pointer[Descriptors]
+	reflection  bool
+	keyMasks    map[string]*KeyMask
+
+	policyRules   []PolicyRule
+	defaultPolicy MethodPolicy
+	policies      *policyTable
+
+	clusterCfgs    []Cluster
+	routeCfgs      []Route
+	defaultCluster string
+	clusters       []*cluster
+	routes         *routeTable
+
+	// reflected holds the files loaded via server reflection from every
+	// cluster so far, by name.
+	reflectMu sync.Mutex
+	reflected map[string]*descriptorpb.FileDescriptorProto
+
+	// peerConns holds a connection per peer replica keys are forwarded to.
+	peerTLS   *tls.Config
+	peerMu    sync.Mutex
+	peerConns map[string]*grpc.ClientConn
+
+	// closing is cancelled by Close to stop background work.
+	closing context.Context
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// HandlerOption configures optional Handler behaviour.
+type HandlerOption func(*Handler)
+
+// WithServerStreaming collapses calls to the given server-streaming methods
+// (e.g. /pkg.Service/Watch) through streams instead of treating them as
+// unary calls.
+func WithServerStreaming(streams *collapser.StreamGroup, methods ...string) HandlerOption {
+	return func(h *Handler) {
+		h.streams = streams
+		for _, method := range methods {
+			h.streamingMethods[method] = true
+		}
+	}
+}
+
+// WithPassthrough pipes calls to the given client-streaming and bidi methods
+// straight to the backend without collapsing.
+func WithPassthrough(methods ...string) HandlerOption {
+	return func(h *Handler) {
+		for _, method := range methods {
+			h.passthroughMethods[method] = true
+		}
+	}
+}
+
+// WithBackendConfig configures the connection pool of the DefaultCluster.
+func WithBackendConfig(cfg BackendConfig) HandlerOption {
+	return func(h *Handler) {
+		h.backendCfg = cfg
+	}
+}
+
+// WithServerTLS serves clients over TLS, or mTLS when cfg verifies client
+// certificates. See NewServerTLS.
+func WithServerTLS(cfg *tls.Config) HandlerOption {
+	return func(h *Handler) {
+		h.serverTLS = cfg
+	}
+}
+
+// WithMetadataFilter limits which client metadata is propagated to the
+// backend. By default every non-reserved key is propagated.
+func WithMetadataFilter(f MetadataFilter) HandlerOption {
+	return func(h *Handler) {
+		h.mdFilter = f
+	}
+}
+
+// DefaultCredentialMetadata are the metadata keys treated as credentials
+// unless WithCredentialMetadata says otherwise.
+var DefaultCredentialMetadata = []string{"authorization", "cookie", "proxy-authorization", "x-api-key"}
+
+// WithKeyMetadata makes the values of the given metadata keys part of the
+// collapse key, so only requests that agree on them share a backend call and
+// cached result.
+func WithKeyMetadata(keys ...string) HandlerOption {
+	return func(h *Handler) {
+		for _, key := range keys {
+			h.keyMetadata = append(h.keyMetadata, strings.ToLower(key))
+		}
+		slices.Sort(h.keyMetadata)
+		h.keyMetadata = slices.Compact(h.keyMetadata)
+	}
+}
+
+// WithCredentialMetadata replaces DefaultCredentialMetadata. Requests carrying
+// any of these keys are never collapsed or cached unless the key is also part
+// of the collapse key via WithKeyMetadata.
+func WithCredentialMetadata(keys ...string) HandlerOption {
+	return func(h *Handler) {
+		h.credentialMetadata = h.credentialMetadata[:0]
+		for _, key := range keys {
+			h.credentialMetadata = append(h.credentialMetadata, strings.ToLower(key))
+		}
+	}
+}
+
+// WithDescriptors decodes requests of described methods to compute
+// canonical collapse keys, and routes streaming methods by their descriptor.
+func WithDescriptors(d *Descriptors) HandlerOption {
+	return func(h *Handler) {
+		h.descriptors.Store(d)
+	}
+}
+
+// WithKeyMasks sets which request fields make up the collapse key, by full
+// method name or by the glob pattern of a policy rule (see WithPolicies),
+// which then applies to the methods that rule resolves. Masks only apply to
+// methods with descriptors.
+func WithKeyMasks(masks map[string]KeyMask) HandlerOption {
+	return func(h *Handler) {
+		for method, mask := range masks {
+			h.keyMasks[method] = &mask
+		}
+	}
+}
+
+// WithPolicies sets how calls are collapsed and cached, per method.
+// Methods matching no rule follow their descriptor when described (see
+// Handler.policy) and use fallback otherwise, which without this option is
+// collapse+cache.
+func WithPolicies(rules []PolicyRule, fallback MethodPolicy) HandlerOption {
+	return func(h *Handler) {
+		h.policyRules = rules
+		h.defaultPolicy = fallback
+	}
+}
+
+// WithReflection loads descriptors from the backend's server reflection
+// service in the background, retrying until it succeeds. Until then requests
+// are keyed on their raw bytes.
+func WithReflection() HandlerOption {
+	return func(h *Handler) {
+		h.reflection = true
+	}
+}
+
+// NewHandler creates a Handler proxying to backendAddr, and to the clusters
+// of WithRoutes, over pools of long-lived connections. backendAddr may be
+// empty when routes are set. Close releases the connections.
+func NewHandler(c *collapser.Collapser, backendAddr string, opts ...HandlerOption) (*Handler, error) {
+	h := &Handler{
+		collapser:        c,
+		streamingMethods: make(map[string]bool),
+
+		passthroughMethods: make(map[string]bool),
+
+		credentialMetadata: slices.Clone(DefaultCredentialMetadata),
+		keyMasks:           make(map[string]*KeyMask),
+		defaultPolicy:      MethodPolicy{Mode: ModeCollapseCache},
+		reflected:          make(map[string]*descriptorpb.FileDescriptorProto),
+		peerConns:          make(map[string]*grpc.ClientConn),
+	}
+	h.closing, h.stop = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(h)
+	}
+	policies, err := newPolicyTable(h.policyRules, h.defaultPolicy)
+	if err != nil {
+		h.stop()
+		return nil, err
+	}
+	h.policies = policies
+	for pattern := range h.keyMasks {
+		if isGlob(pattern) && !slices.ContainsFunc(policies.globs, func(r PolicyRule) bool { return r.Pattern == pattern }) {
+			h.stop()
+			return nil, fmt.Errorf("key mask %s: a glob must be the pattern of a policy rule", pattern)
+		}
+	}
+	if d := h.descriptors.Load(); d != nil {
+		if err := h.validateKeyMasks(d); err != nil {
+			h.stop()
+			return nil, err
+		}
+	}
+
+	if err := h.newClusters(backendAddr); err != nil {
+		h.Close()
+		return nil, err
+	}
+
+	if h.reflection {
+		for _, c := range h.clusters {
+			h.wg.Add(1)
+			go h.loadReflection(c)
+		}
+	}
+	return h, nil
 }
 
-func NewHandler(c *collapser.Collapser, backendAddr string) *Handler {
-	return &Handler{
-		backendAddr: backendAddr,
-		collapser:   c,
+// Close closes the connection pools of every cluster and the connections to
+// peer replicas.
+func (h *Handler) Close() error {
+	h.stop()
+	h.wg.Wait()
+	errs := []error{h.closePeers()}
+	for _, c := range h.clusters {
+		errs = append(errs, c.backend.Close())
 	}
+	return errors.Join(errs...)
 }
 
 func (h *Handler) Serve(lis net.Listener) error {
-	s := grpc.NewServer(grpc.UnknownServiceHandler(h.Handle))
+	opts := []grpc.ServerOption{
+		grpc.UnknownServiceHandler(h.Handle),
+		grpc.ForceServerCodecV2(RawCodec{}),
+	}
+	if h.serverTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(h.serverTLS)))
+	}
+	s := grpc.NewServer(opts...)
 	return s.Serve(lis)
 }
 
@@ -35,6 +275,15 @@ func (h *Handler) Handle(srv interface{}, stream grpc.ServerStream) error {
 	if !ok {
 		return status.Errorf(codes.Internal, "cannot extract method")
 	}
+	cluster, ok := h.routes.lookup(method)
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "no backend serves %s", method)
+	}
+	backend := cluster.backend
+	kind := h.methodKind(method)
+	if kind == passthroughMethod {
+		return h.passthrough(stream, backend, method)
+	}
 
 	in := &RawMessage{}
 	if err := stream.RecvMsg(in); err != nil {
@@ -44,27 +293,228 @@ func (h *Handler) Handle(srv interface{}, stream grpc.ServerStream) error {
 		return err
 	}
 
-	key := h.generateKey(method, in.Data)
-	resp, err := h.collapser.Execute(stream.Context(), key, func(ctx context.Context) ([]byte, error) {
-		return Forward(ctx, h.backendAddr, method, in.Data)
-	})
+	if kind == serverStreamingMethod {
+		return h.handleServerStream(stream, backend, method, in.Data)
+	}
+
+	ctx := stream.Context()
+	forwarded := isForwarded(ctx)
+	if forwarded {
+		// Tell the forwarding replica it reached the owner, then collapse here
+		if err := stream.SendHeader(metadata.Pairs(ownerHeader, "true")); err != nil {
+			return err
+		}
+		ctx = collapser.WithLocalExecution(ctx)
+	}
+
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	subtype := contentSubtype(incoming)
+	policy := h.policy(method)
+	var resp []byte
+	var outcome collapser.Outcome
+	var err error
+	if reason := h.uncollapsedReason(policy, incoming); reason != "" {
+		monitoring.UncollapsedRequestsTotal.WithLabelValues(reason).Inc()
+		// Bounded like a collapsed call, by the policy or BackendTimeout
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.collapser.Timeout(policy.collapserPolicy()))
+		defer cancel()
+		resp, err = h.invoke(h.mdFilter.outgoing(ctx, incoming), backend, method, subtype, in.Data)
+	} else {
+		key := h.generateKey(method, in.Data, incoming)
+		resp, outcome, err = h.collapser.ExecuteWithPolicy(ctx, key, policy.collapserPolicy(), func(ctx context.Context) ([]byte, error) {
+			return h.invoke(withHashKey(h.withKeyMetadata(h.mdFilter.outgoing(ctx, incoming), incoming), key), backend, method, subtype, in.Data)
+		})
+	}
 
 	if err != nil {
+		var respErr *responseError
+		if errors.As(err, &respErr) {
+			replayMetadata(stream, respErr.header, respErr.trailer, forwarded)
+		}
 		return err
 	}
+	r, err := decodeResponse(resp)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	replayMetadata(stream, r.header, r.trailer, forwarded)
+	if outcome.Stale {
+		stream.SetTrailer(metadata.Pairs(StaleTrailer, "true"))
+	}
+
+	return stream.SendMsg(&RawMessage{Data: r.data})
+}
+
+// invoke calls the owning peer or the backend with the client's
+// content-subtype and captures the response metadata along with the payload,
+// so it is cached and shared with it.
+func (h *Handler) invoke(ctx context.Context, backend *Backend, method, subtype string, data []byte) ([]byte, error) {
+	var header, trailer metadata.MD
+	opts := []grpc.CallOption{grpc.CallContentSubtype(subtype), grpc.Header(&header), grpc.Trailer(&trailer)}
+	var out []byte
+	var err error
+	if peer, ok := collapser.PeerFromContext(ctx); ok {
+		out, err = h.forwardToPeer(ctx, peer, method, data, opts...)
+	} else {
+		out, err = backend.Invoke(ctx, method, data, opts...)
+	}
+
+	header, trailer = responseMetadata(header), responseMetadata(trailer)
+	if err != nil {
+		if len(header) > 0 || len(trailer) > 0 {
+			return nil, &responseError{err: err, header: header, trailer: trailer}
+		}
+		return nil, err
+	}
+	return (&response{data: out, header: header, trailer: trailer}).encode(), nil
+}
+
+// replayMetadata sends the backend's response metadata to a client. When
+// headers were already sent, as for calls forwarded by another replica, the
+// backend's headers travel as trailers instead.
+func replayMetadata(stream grpc.ServerStream, header, trailer metadata.MD, headerSent bool) {
+	if len(header) > 0 {
+		if headerSent {
+			stream.SetTrailer(header)
+		} else if err := stream.SetHeader(header); err != nil {
+			stream.SetTrailer(header)
+		}
+	}
+	stream.SetTrailer(trailer)
+}
+
+// handleServerStream fans one upstream server stream out to every identical
+// call, replaying already sent messages and the backend's header to late
+// joiners and relaying its trailer once the stream ends.
+func (h *Handler) handleServerStream(stream grpc.ServerStream, backend *Backend, method string, data []byte) error {
+	incoming, _ := metadata.FromIncomingContext(stream.Context())
+	subtype := grpc.CallContentSubtype(contentSubtype(incoming))
+	send := func(msg []byte) error {
+		return stream.SendMsg(&RawMessage{Data: msg})
+	}
+
+	policy := h.policy(method)
+	if reason := h.uncollapsedReason(policy, incoming); reason != "" {
+		monitoring.UncollapsedRequestsTotal.WithLabelValues(reason).Inc()
+		// Streams are long-lived, so only a policy timeout bounds them, as
+		// it would a unary call
+		ctx := stream.Context()
+		if policy.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+			defer cancel()
+		}
+		src, err := backend.OpenStream(h.mdFilter.outgoing(ctx, incoming), method, data, subtype)
+		if err != nil {
+			return err
+		}
+		md, _ := src.(collapser.MetadataSource)
+		if md != nil {
+			// A failed header read surfaces again from Recv
+			if header, err := md.Header(); err == nil {
+				stream.SetHeader(responseMetadata(header))
+			}
+		}
+		for {
+			msg, err := src.Recv()
+			if err != nil {
+				if md != nil {
+					stream.SetTrailer(responseMetadata(md.Trailer()))
+				}
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return err
+			}
+			if err := send(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	key := h.generateKey(method, data, incoming)
+	trailer, err := h.streams.StreamWithMetadata(stream.Context(), key, func(ctx context.Context) (collapser.StreamSource, error) {
+		return backend.OpenStream(withHashKey(h.mdFilter.outgoing(ctx, incoming), key), method, data, subtype)
+	}, send, func(header metadata.MD) error {
+		return stream.SetHeader(responseMetadata(header))
+	})
+	stream.SetTrailer(responseMetadata(trailer))
+	return err
+}
 
-	return stream.SendMsg(&RawMessage{Data: resp})
+// uncollapsedReason returns why a call must go straight to the backend, or
+// "" when it may be collapsed.
+func (h *Handler) uncollapsedReason(policy MethodPolicy, md metadata.MD) string {
+	switch {
+	case policy.Mode == ModePassthrough:
+		return "policy"
+	case h.carriesCredentials(md):
+		// Never share a response between callers that may not be the same user
+		return "credentials"
+	}
+	return ""
 }
 
-func (h *Handler) generateKey(method string, data []byte) string {
-	hash := sha256.Sum256(data)
-	return method + ":" + hex.EncodeToString(hash[:])
+// carriesCredentials reports whether md holds a credential that is not part
+// of the collapse key.
+func (h *Handler) carriesCredentials(md metadata.MD) bool {
+	for _, key := range h.credentialMetadata {
+		if len(md.Get(key)) > 0 && !slices.Contains(h.keyMetadata, key) {
+			return true
+		}
+	}
+	return false
 }
 
-type RawMessage struct {
-	Data []byte
+// configuredKeyMask returns the mask set for method by name or, failing
+// that, for the pattern of the policy rule method matches.
+func (h *Handler) configuredKeyMask(method string) *KeyMask {
+	if mask := h.keyMasks[method]; mask != nil {
+		return mask
+	}
+	if rule, ok := h.policies.match(method); ok {
+		return h.keyMasks[rule.Pattern]
+	}
+	return nil
 }
 
-func (m *RawMessage) Reset()         { m.Data = nil }
-func (m *RawMessage) String() string { return string(m.Data) }
-func (m *RawMessage) ProtoMessage()  {}
+// generateKey identifies a request by method, content-subtype, payload and
+// the values of the collapse key metadata. Protobuf payloads of described
+// methods are canonicalized first.
+func (h *Handler) generateKey(method string, data []byte, md metadata.MD) string {
+	subtype := contentSubtype(md)
+	d := h.descriptors.Load()
+	if desc, ok := d.Method(method); ok && isProtoSubtype(subtype) {
+		// Configured masks take precedence over (collapser.policy) ones
+		mask := h.configuredKeyMask(method)
+		if mask == nil {
+			a, _ := d.annotation(method)
+			mask = a.mask
+		}
+		// Requests that do not parse are still keyed on their raw bytes
+		if canonical, err := canonicalize(desc.Input(), data, mask); err == nil {
+			data = canonical
+		}
+	}
+
+	hash := sha256.New()
+	if !isProtoSubtype(subtype) {
+		// The same bytes mean a different request in another encoding
+		hash.Write(binary.AppendUvarint(nil, uint64(len(subtype))))
+		hash.Write([]byte(subtype))
+	}
+	hash.Write(data)
+	for _, key := range h.keyMetadata {
+		values := md.Get(key)
+		// Length-prefix everything so different splits never hash alike
+		hash.Write(binary.AppendUvarint(nil, uint64(len(key))))
+		hash.Write([]byte(key))
+		hash.Write(binary.AppendUvarint(nil, uint64(len(values))))
+		for _, value := range values {
+			hash.Write(binary.AppendUvarint(nil, uint64(len(value))))
+			hash.Write([]byte(value))
+		}
+	}
+	return method + ":" + hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const bufTarget = "passthrough:///bufnet"
+
+// startBufServer serves handler on an in-memory listener and returns a dial
+// option connecting to it.
+func startBufServer(b *testing.B, handler grpc.StreamHandler) grpc.DialOption {
+	b.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(handler))
+	go s.Serve(lis)
+	b.Cleanup(s.Stop)
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+}
+
+func echoHandler(srv interface{}, stream grpc.ServerStream) error {
+	in := &RawMessage{}
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return stream.SendMsg(&RawMessage{Data: append([]byte("echo:"), in.Data...)})
+}
+
+// dialPerRequestHandler forwards every call over a fresh connection, the
+// way the proxy did before it kept a connection pool.
+func dialPerRequestHandler(backend grpc.DialOption) grpc.StreamHandler {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		in := &RawMessage{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		conn, err := grpc.NewClient(bufTarget, grpc.WithTransportCredentials(insecure.NewCredentials()), rawCallCodec, backend)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		var out RawMessage
+		if err := conn.Invoke(stream.Context(), method, in, &out); err != nil {
+			return err
+		}
+		return stream.SendMsg(&out)
+	}
+}
+
+// benchmarkEndToEnd sends distinct requests through a proxy so that every
+// call reaches the backend.
+func benchmarkEndToEnd(b *testing.B, proxy grpc.DialOption) {
+	conn, err := grpc.NewClient(bufTarget, grpc.WithTransportCredentials(insecure.NewCredentials()), rawCallCodec, proxy)
+	if err != nil {
+		b.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	var i int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			data := fmt.Sprintf("req-%d", atomic.AddInt64(&i, 1))
+			if _, err := invoke(context.Background(), conn, data); err != nil {
+				b.Errorf("invoke failed: %v", err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkHandler_EndToEnd compares a client -> proxy -> backend round trip
+// over in-memory listeners with a pooled backend client against dialing the
+// backend for every request. ForwardedToPeer adds a hop to the replica
+// owning every key, over TCP.
+func BenchmarkHandler_EndToEnd(b *testing.B) {
+	b.Run("DialPerRequest", func(b *testing.B) {
+		backend := startBufServer(b, echoHandler)
+		benchmarkEndToEnd(b, startBufServer(b, dialPerRequestHandler(backend)))
+	})
+
+	b.Run("Pooled", func(b *testing.B) {
+		backend := startBufServer(b, echoHandler)
+		c := collapser.NewCollapser(collapser.Config{
+			BackendTimeout:  10 * time.Second,
+			CleanupInterval: 1 * time.Second,
+		})
+		c.Start()
+		defer c.Stop()
+		h, err := NewHandler(c, bufTarget, WithBackendConfig(BackendConfig{
+			DialOptions: []grpc.DialOption{backend},
+		}))
+		if err != nil {
+			b.Fatalf("failed to create handler: %v", err)
+		}
+		defer h.Close()
+		benchmarkEndToEnd(b, startBufServer(b, h.Handle))
+	})
+
+	b.Run("ForwardedToPeer", func(b *testing.B) {
+		backend := startBackend(b, 0)
+		ownerLis, forwarderLis := listen(b), listen(b)
+		owner, forwarder := ownerLis.Addr().String(), forwarderLis.Addr().String()
+		startProxy(b, ownerLis, backend.addr)
+		// The forwarder's ring holds only the owner, so it forwards every key
+		h := startProxy(b, forwarderLis, backend.addr, collapser.WithPeers(collapser.NewHashRing(forwarder, []string{owner}, 50)))
+		benchmarkEndToEnd(b, startBufServer(b, h.Handle))
+	})
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const testMethod = "/test.EchoService/Echo"
+
+// testBackend is an echo server that counts the calls it receives.
+type testBackend struct {
+	addr  string
+	calls atomic.Int64
+	delay time.Duration
+}
+
+func startBackend(t testing.TB, delay time.Duration) *testBackend {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	b := &testBackend{addr: lis.Addr().String(), delay: delay}
+	s := grpc.NewServer(grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		in := &RawMessage{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		b.calls.Add(1)
+		time.Sleep(b.delay)
+		return stream.SendMsg(&RawMessage{Data: append([]byte("echo:"), in.Data...)})
+	}))
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return b
+}
+
+// listen reserves a local address for a proxy before it is started, so
+// replicas can be told about each other up front.
+func listen(t testing.TB) net.Listener {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	return lis
+}
+
+func startProxy(t testing.TB, lis net.Listener, backendAddr string, opts ...collapser.Option) *Handler {
+	t.Helper()
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: 100 * time.Millisecond,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     1 * time.Second,
+	}, opts...)
+	c.Start()
+	t.Cleanup(func() { c.Stop() })
+
+	return serve(t, lis, c, backendAddr)
+}
+
+// serve starts a Handler on lis that collapses through c.
+func serve(t testing.TB, lis net.Listener, c *collapser.Collapser, backendAddr string, opts ...HandlerOption) *Handler {
+	t.Helper()
+	h, err := NewHandler(c, backendAddr, opts...)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	go h.Serve(lis)
+	return h
+}
+
+// rawCallCodec lets test clients send and receive RawMessage frames.
+var rawCallCodec = grpc.WithDefaultCallOptions(grpc.ForceCodecV2(RawCodec{}))
+
+func dial(t testing.TB, addr string) *grpc.ClientConn {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), rawCallCodec)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func invoke(ctx context.Context, conn *grpc.ClientConn, data string) (string, error) {
+	var out RawMessage
+	if err := conn.Invoke(ctx, testMethod, &RawMessage{Data: []byte(data)}, &out); err != nil {
+		return "", err
+	}
+	return string(out.Data), nil
+}
+
+func TestHandler_CollapsesIdenticalRequests(t *testing.T) {
+	backend := startBackend(t, 50*time.Millisecond)
+	lis := listen(t)
+	startProxy(t, lis, backend.addr)
+	conn := dial(t, lis.Addr().String())
+
+	errCh := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			resp, err := invoke(context.Background(), conn, "hello")
+			if err == nil && resp != "echo:hello" {
+				t.Errorf("expected 'echo:hello', got %q", resp)
+			}
+			errCh <- err
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 backend call, got %d", calls)
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/logger"
+	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
+	"go.uber.org/zap"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthCheck configures active grpc.health.v1 checks of backend endpoints.
+type HealthCheck struct {
+	// Interval is the time between checks of each endpoint. Zero disables
+	// health checking.
+	Interval time.Duration
+	// Timeout bounds each check. Zero uses Interval.
+	Timeout time.Duration
+	// Service is the service name sent with each check. Empty asks about
+	// the server as a whole.
+	Service string
+
+	// UnhealthyThreshold consecutive failed checks take an endpoint out of
+	// rotation, and HealthyThreshold consecutive passed checks put it back.
+	// Zero uses 1.
+	UnhealthyThreshold int
+	HealthyThreshold   int
+}
+
+// checkHealth probes e until ctx is cancelled, updating whether it is in
+// rotation. Endpoints start out healthy so calls flow before the first check.
+func (b *Backend) checkHealth(ctx context.Context, e *endpoint, hc HealthCheck) {
+	defer b.wg.Done()
+
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = hc.Interval
+	}
+	unhealthyThreshold := max(hc.UnhealthyThreshold, 1)
+	healthyThreshold := max(hc.HealthyThreshold, 1)
+
+	monitoring.BackendEndpointHealthy.WithLabelValues(e.addr).Set(1)
+	defer monitoring.BackendEndpointHealthy.DeleteLabelValues(e.addr)
+
+	client := healthpb.NewHealthClient(e.conns[0])
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	var passed, failed int
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err := client.Check(checkCtx, &healthpb.HealthCheckRequest{Service: hc.Service})
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		ok := err == nil && resp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+		if ok {
+			passed, failed = passed+1, 0
+			monitoring.BackendHealthChecksTotal.WithLabelValues(e.addr, "pass").Inc()
+		} else {
+			passed, failed = 0, failed+1
+			monitoring.BackendHealthChecksTotal.WithLabelValues(e.addr, "fail").Inc()
+		}
+
+		switch healthy := e.healthy.Load(); {
+		case healthy && failed >= unhealthyThreshold:
+			e.healthy.Store(false)
+			monitoring.BackendEndpointHealthy.WithLabelValues(e.addr).Set(0)
+			logger.Warn("backend endpoint failed health checks, removed from rotation",
+				zap.String("endpoint", e.addr),
+				zap.String("status", resp.GetStatus().String()),
+				zap.Error(err))
+		case !healthy && passed >= healthyThreshold:
+			e.healthy.Store(true)
+			monitoring.BackendEndpointHealthy.WithLabelValues(e.addr).Set(1)
+			logger.Info("backend endpoint passed health checks, back in rotation", zap.String("endpoint", e.addr))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
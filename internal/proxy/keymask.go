@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// KeyMask selects the request fields that make up a method's collapse key.
+// Paths are dotted field names (e.g. meta.request_id); paths through
+// repeated messages apply to every element. Set Ignore or Only, not both.
+type KeyMask struct {
+	// Ignore lists fields left out of the key, such as request IDs.
+	Ignore []string
+	// Only lists the only fields that are part of the key.
+	Only []string
+}
+
+// apply returns msg with the mask applied.
+func (k KeyMask) apply(msg protoreflect.Message) protoreflect.Message {
+	for _, path := range k.Ignore {
+		clearPath(msg, strings.Split(path, "."))
+	}
+	if len(k.Only) == 0 {
+		return msg
+	}
+	kept := dynamicpb.NewMessage(msg.Descriptor())
+	for _, path := range k.Only {
+		keepPath(msg, kept, strings.Split(path, "."))
+	}
+	return kept
+}
+
+// validate checks that every path names a field of desc.
+func (k KeyMask) validate(desc protoreflect.MessageDescriptor) error {
+	for _, path := range append(k.Ignore, k.Only...) {
+		md := desc
+		for i, name := range strings.Split(path, ".") {
+			if md == nil {
+				return fmt.Errorf("field path %q: %s is not a message", path, strings.Join(strings.Split(path, ".")[:i], "."))
+			}
+			fd := md.Fields().ByName(protoreflect.Name(name))
+			if fd == nil {
+				return fmt.Errorf("field path %q: %s has no field %s", path, md.FullName(), name)
+			}
+			md = nil
+			if fd.Message() != nil && !fd.IsMap() {
+				md = fd.Message()
+			}
+		}
+	}
+	return nil
+}
+
+func clearPath(msg protoreflect.Message, path []string) {
+	fd := msg.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	if fd == nil {
+		return
+	}
+	if len(path) == 1 {
+		msg.Clear(fd)
+		return
+	}
+	if fd.Message() == nil || fd.IsMap() || !msg.Has(fd) {
+		return
+	}
+	if fd.IsList() {
+		list := msg.Get(fd).List()
+		for i := 0; i < list.Len(); i++ {
+			clearPath(list.Get(i).Message(), path[1:])
+		}
+		return
+	}
+	clearPath(msg.Mutable(fd).Message(), path[1:])
+}
+
+func keepPath(src, dst protoreflect.Message, path []string) {
+	fd := src.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	if fd == nil || !src.Has(fd) {
+		return
+	}
+	if len(path) == 1 {
+		dst.Set(fd, src.Get(fd))
+		return
+	}
+	if fd.Message() == nil || fd.IsMap() {
+		return
+	}
+	if fd.IsList() {
+		from, to := src.Get(fd).List(), dst.Mutable(fd).List()
+		for to.Len() < from.Len() {
+			to.Append(to.NewElement())
+		}
+		for i := 0; i < from.Len(); i++ {
+			keepPath(from.Get(i).Message(), to.Get(i).Message(), path[1:])
+		}
+		return
+	}
+	keepPath(src.Get(fd).Message(), dst.Mutable(fd).Message(), path[1:])
+}
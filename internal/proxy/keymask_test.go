@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendMeta(b []byte, field protowire.Number, requestID, trace string) []byte {
+	var meta []byte
+	meta = protowire.AppendTag(meta, 1, protowire.BytesType)
+	meta = protowire.AppendString(meta, requestID)
+	meta = protowire.AppendTag(meta, 2, protowire.BytesType)
+	meta = protowire.AppendString(meta, trace)
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, meta)
+}
+
+// maskedRequest builds an EchoRequest with a volatile request ID and trace
+// in meta and in each of its two items.
+func maskedRequest(name, requestID, trace string) []byte {
+	b := appendName(nil, name)
+	b = appendMeta(b, 3, requestID, trace)
+	b = appendMeta(b, 4, requestID+"-1", trace)
+	return appendMeta(b, 4, requestID+"-2", trace)
+}
+
+func newMaskHandler(t *testing.T, mask KeyMask) *Handler {
+	t.Helper()
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	return serve(t, listen(t), c, "127.0.0.1:1",
+		WithDescriptors(echoDescriptors(t)),
+		WithKeyMasks(map[string]KeyMask{testMethod: mask}))
+}
+
+func TestKeyMask_Ignore(t *testing.T) {
+	h := newMaskHandler(t, KeyMask{Ignore: []string{"meta.request_id", "items.request_id"}})
+
+	key := h.generateKey(testMethod, maskedRequest("a", "r1", "t1"), nil)
+	if h.generateKey(testMethod, maskedRequest("a", "r2", "t1"), nil) != key {
+		t.Error("expected requests differing only in ignored fields to share the key")
+	}
+	if h.generateKey(testMethod, maskedRequest("a", "r1", "t2"), nil) == key {
+		t.Error("expected requests differing in trace to have different keys")
+	}
+	if h.generateKey(testMethod, maskedRequest("b", "r1", "t1"), nil) == key {
+		t.Error("expected requests differing in name to have different keys")
+	}
+}
+
+func TestKeyMask_Only(t *testing.T) {
+	h := newMaskHandler(t, KeyMask{Only: []string{"name", "items.trace"}})
+
+	key := h.generateKey(testMethod, maskedRequest("a", "r1", "t1"), nil)
+	if h.generateKey(testMethod, maskedRequest("a", "r2", "t1"), nil) != key {
+		t.Error("expected requests differing only in unlisted fields to share the key")
+	}
+	if h.generateKey(testMethod, maskedRequest("a", "r1", "t2"), nil) == key {
+		t.Error("expected requests differing in items.trace to have different keys")
+	}
+	if h.generateKey(testMethod, maskedRequest("b", "r1", "t1"), nil) == key {
+		t.Error("expected requests differing in name to have different keys")
+	}
+}
+
+func TestKeyMask_RejectsUnknownFields(t *testing.T) {
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	for _, path := range []string{"missing", "meta.missing", "name.sub"} {
+		_, err := NewHandler(c, "127.0.0.1:1",
+			WithDescriptors(echoDescriptors(t)),
+			WithKeyMasks(map[string]KeyMask{testMethod: {Ignore: []string{path}}}))
+		if err == nil {
+			t.Errorf("expected an error for field path %q", path)
+		}
+	}
+}
+
+func TestKeyMask_GlobRule(t *testing.T) {
+	const pattern = "/test.EchoService/*"
+	rules := WithPolicies([]PolicyRule{{Pattern: pattern, Policy: MethodPolicy{Mode: ModeCollapseCache}}}, MethodPolicy{Mode: ModePassthrough})
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	h := serve(t, listen(t), c, "127.0.0.1:1", WithDescriptors(echoDescriptors(t)), rules,
+		WithKeyMasks(map[string]KeyMask{pattern: {Ignore: []string{"meta.request_id", "items.request_id"}}}))
+
+	if h.generateKey(testMethod, maskedRequest("a", "r1", "t1"), nil) != h.generateKey(testMethod, maskedRequest("a", "r2", "t1"), nil) {
+		t.Error("expected the mask of the matching glob rule to apply")
+	}
+
+	for name, masks := range map[string]map[string]KeyMask{
+		"glob without a rule": {"/test.*/*": {Ignore: []string{"meta.request_id"}}},
+		"unknown field":       {pattern: {Ignore: []string{"missing"}}},
+	} {
+		if _, err := NewHandler(c, "127.0.0.1:1", WithDescriptors(echoDescriptors(t)), rules, WithKeyMasks(masks)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
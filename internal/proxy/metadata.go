@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MetadataFilter decides which incoming metadata keys are propagated to the
+// backend. Entries are lowercase keys; a trailing '*' matches any key with
+// that prefix. An empty Allow list allows every key not denied.
+type MetadataFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// Allowed reports whether key may be propagated to the backend.
+func (f MetadataFilter) Allowed(key string) bool {
+	if isReservedMetadata(key) || matchesAny(f.Deny, key) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchesAny(f.Allow, key)
+}
+
+// outgoing returns ctx carrying the allowed subset of incoming as outgoing
+// metadata for the backend call.
+func (f MetadataFilter) outgoing(ctx context.Context, incoming metadata.MD) context.Context {
+	md := metadata.MD{}
+	for key, values := range incoming {
+		if f.Allowed(key) {
+			md[key] = append([]string(nil), values...)
+		}
+	}
+	if len(md) == 0 {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// isReservedMetadata reports keys that belong to a single hop: HTTP/2 pseudo
+// headers, headers gRPC sets itself, and the proxy's own headers.
+func isReservedMetadata(key string) bool {
+	switch key {
+	case "content-type", "user-agent", "te":
+		return true
+	}
+	return strings.HasPrefix(key, ":") ||
+		strings.HasPrefix(key, "grpc-") ||
+		strings.HasPrefix(key, "x-collapser-")
+}
+
+// responseMetadata strips reserved keys from backend response metadata.
+func responseMetadata(md metadata.MD) metadata.MD {
+	out := metadata.MD{}
+	for key, values := range md {
+		if !isReservedMetadata(key) {
+			out[key] = values
+		}
+	}
+	return out
+}
+
+// response is a backend reply as stored by the collapser, so its headers and
+// trailers can be replayed to followers and cache hits.
+type response struct {
+	data    []byte
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+const (
+	responseDataField    protowire.Number = 1
+	responseHeaderField  protowire.Number = 2
+	responseTrailerField protowire.Number = 3
+
+	pairKeyField   protowire.Number = 1
+	pairValueField protowire.Number = 2
+)
+
+// encode serializes the response with the protobuf wire format.
+func (r *response) encode() []byte {
+	b := protowire.AppendTag(nil, responseDataField, protowire.BytesType)
+	b = protowire.AppendBytes(b, r.data)
+	b = appendMetadata(b, responseHeaderField, r.header)
+	return appendMetadata(b, responseTrailerField, r.trailer)
+}
+
+func appendMetadata(b []byte, field protowire.Number, md metadata.MD) []byte {
+	for key, values := range md {
+		for _, value := range values {
+			var pair []byte
+			pair = protowire.AppendTag(pair, pairKeyField, protowire.BytesType)
+			pair = protowire.AppendString(pair, key)
+			pair = protowire.AppendTag(pair, pairValueField, protowire.BytesType)
+			pair = protowire.AppendString(pair, value)
+			b = protowire.AppendTag(b, field, protowire.BytesType)
+			b = protowire.AppendBytes(b, pair)
+		}
+	}
+	return b
+}
+
+var errMalformedResponse = errors.New("malformed collapsed response")
+
+func decodeResponse(b []byte) (*response, error) {
+	r := &response{header: metadata.MD{}, trailer: metadata.MD{}}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			return nil, errMalformedResponse
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, errMalformedResponse
+		}
+		b = b[n:]
+
+		switch num {
+		case responseDataField:
+			r.data = v
+		case responseHeaderField, responseTrailerField:
+			key, value, err := decodePair(v)
+			if err != nil {
+				return nil, err
+			}
+			if num == responseHeaderField {
+				r.header.Append(key, value)
+			} else {
+				r.trailer.Append(key, value)
+			}
+		}
+	}
+	return r, nil
+}
+
+func decodePair(b []byte) (key, value string, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			return "", "", errMalformedResponse
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeString(b)
+		if n < 0 {
+			return "", "", errMalformedResponse
+		}
+		b = b[n:]
+		switch num {
+		case pairKeyField:
+			key = v
+		case pairValueField:
+			value = v
+		}
+	}
+	return key, value, nil
+}
+
+// responseError is a backend error together with the metadata it was
+// returned with, so the metadata is replayed along with the error.
+type responseError struct {
+	err     error
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+func (e *responseError) Error() string { return e.err.Error() }
+func (e *responseError) Unwrap() error { return e.err }
+
+// GRPCStatus keeps the backend's status code when the error is returned to
+// clients or persisted by a cache.
+func (e *responseError) GRPCStatus() *status.Status {
+	return status.Convert(e.err)
+}
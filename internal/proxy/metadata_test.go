@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startMetadataBackend echoes requests, returning the metadata keys it
+// received in an x-received header and x-trace-id back as a trailer.
+// Requests for "missing" fail with NotFound and the same metadata.
+func startMetadataBackend(t testing.TB, delay time.Duration) (string, *atomic.Int64) {
+	t.Helper()
+	lis := listen(t)
+	var calls atomic.Int64
+	s := grpc.NewServer(grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		in := &RawMessage{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		calls.Add(1)
+		time.Sleep(delay)
+
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		var keys []string
+		for key := range md {
+			if !isReservedMetadata(key) {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+		stream.SetHeader(metadata.Pairs("x-received", strings.Join(keys, ",")))
+		stream.SetTrailer(metadata.MD{"x-trace-id": md.Get("x-trace-id")})
+
+		if string(in.Data) == "missing" {
+			return status.Error(codes.NotFound, "not found")
+		}
+		return stream.SendMsg(&RawMessage{Data: append([]byte("echo:"), in.Data...)})
+	}))
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String(), &calls
+}
+
+type call struct {
+	resp    string
+	header  metadata.MD
+	trailer metadata.MD
+	err     error
+}
+
+func invokeWithMetadata(ctx context.Context, conn *grpc.ClientConn, data string) call {
+	var c call
+	var out RawMessage
+	c.err = conn.Invoke(ctx, testMethod, &RawMessage{Data: []byte(data)}, &out, grpc.Header(&c.header), grpc.Trailer(&c.trailer))
+	c.resp = string(out.Data)
+	return c
+}
+
+func TestHandler_ReplaysResponseMetadata(t *testing.T) {
+	backendAddr, calls := startMetadataBackend(t, 50*time.Millisecond)
+	lis := listen(t)
+	startProxy(t, lis, backendAddr)
+	conn := dial(t, lis.Addr().String())
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-trace-id", "trace-1")
+	results := make(chan call, 5)
+	for i := 0; i < 5; i++ {
+		go func() { results <- invokeWithMetadata(ctx, conn, "hello") }()
+	}
+	collected := make([]call, 0, 6)
+	for i := 0; i < 5; i++ {
+		collected = append(collected, <-results)
+	}
+	// Served from the result cache
+	collected = append(collected, invokeWithMetadata(ctx, conn, "hello"))
+
+	for _, c := range collected {
+		if c.err != nil {
+			t.Fatalf("unexpected error: %v", c.err)
+		}
+		if c.resp != "echo:hello" {
+			t.Errorf("expected echo:hello, got %q", c.resp)
+		}
+		if got := c.header.Get("x-received"); len(got) != 1 || got[0] != "x-trace-id" {
+			t.Errorf("expected x-received header x-trace-id, got %v", got)
+		}
+		if got := c.trailer.Get("x-trace-id"); len(got) != 1 || got[0] != "trace-1" {
+			t.Errorf("expected x-trace-id trailer trace-1, got %v", got)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 backend call, got %d", n)
+	}
+}
+
+func TestHandler_ReplaysErrorMetadata(t *testing.T) {
+	backendAddr, _ := startMetadataBackend(t, 0)
+	lis := listen(t)
+	startProxy(t, lis, backendAddr)
+	conn := dial(t, lis.Addr().String())
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-trace-id", "trace-2")
+	c := invokeWithMetadata(ctx, conn, "missing")
+	if status.Code(c.err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", c.err)
+	}
+	if got := c.trailer.Get("x-trace-id"); len(got) != 1 || got[0] != "trace-2" {
+		t.Errorf("expected x-trace-id trailer trace-2, got %v", got)
+	}
+}
+
+func TestHandler_MetadataFilter(t *testing.T) {
+	backendAddr, _ := startMetadataBackend(t, 0)
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	lis := listen(t)
+	serve(t, lis, c, backendAddr, WithMetadataFilter(MetadataFilter{
+		Allow: []string{"x-trace-*", "authorization"},
+		Deny:  []string{"x-trace-debug"},
+	}))
+	conn := dial(t, lis.Addr().String())
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"authorization", "Bearer token",
+		"x-trace-id", "trace-3",
+		"x-trace-debug", "1",
+		"x-internal", "secret")
+	res := invokeWithMetadata(ctx, conn, "hello")
+	if res.err != nil {
+		t.Fatalf("unexpected error: %v", res.err)
+	}
+	if got := res.header.Get("x-received"); len(got) != 1 || got[0] != "authorization,x-trace-id" {
+		t.Errorf("expected authorization,x-trace-id to reach the backend, got %v", got)
+	}
+}
+
+func TestResponse_EncodeRoundTrip(t *testing.T) {
+	r := &response{
+		data:    []byte("payload"),
+		header:  metadata.MD{"x-a": {"1", "2"}},
+		trailer: metadata.MD{"x-b": {"3"}, "x-bin": {"\x00\xff"}},
+	}
+	got, err := decodeResponse(r.encode())
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if string(got.data) != "payload" {
+		t.Errorf("expected payload, got %q", got.data)
+	}
+	if !slices.Equal(got.header.Get("x-a"), []string{"1", "2"}) {
+		t.Errorf("expected header x-a [1 2], got %v", got.header.Get("x-a"))
+	}
+	if got.trailer.Get("x-b")[0] != "3" || got.trailer.Get("x-bin")[0] != "\x00\xff" {
+		t.Errorf("unexpected trailer %v", got.trailer)
+	}
+}
+
+func TestHandler_KeyMetadataIsolatesTenants(t *testing.T) {
+	backendAddr, calls := startMetadataBackend(t, 0)
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: time.Minute,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     time.Second,
+	})
+	lis := listen(t)
+	serve(t, lis, c, backendAddr, WithKeyMetadata("X-Tenant-Id", "authorization"))
+	conn := dial(t, lis.Addr().String())
+
+	for _, md := range [][]string{
+		{"x-tenant-id", "a", "authorization", "Bearer alice"},
+		{"x-tenant-id", "a", "authorization", "Bearer alice"}, // cache hit
+		{"x-tenant-id", "a", "authorization", "Bearer bob"},
+		{"x-tenant-id", "b", "authorization", "Bearer alice"},
+	} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), md...)
+		if res := invokeWithMetadata(ctx, conn, "hello"); res.err != nil {
+			t.Fatalf("unexpected error: %v", res.err)
+		}
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 backend calls, got %d", n)
+	}
+}
+
+func TestHandler_CredentialsAreNotCollapsed(t *testing.T) {
+	backendAddr, calls := startMetadataBackend(t, 0)
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: time.Minute,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     time.Second,
+	})
+	lis := listen(t)
+	serve(t, lis, c, backendAddr)
+	conn := dial(t, lis.Addr().String())
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer alice")
+	for i := 0; i < 3; i++ {
+		res := invokeWithMetadata(ctx, conn, "hello")
+		if res.err != nil {
+			t.Fatalf("unexpected error: %v", res.err)
+		}
+		if got := res.header.Get("x-received"); len(got) != 1 || got[0] != "authorization" {
+			t.Errorf("expected authorization to reach the backend, got %v", got)
+		}
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 uncollapsed backend calls, got %d", n)
+	}
+
+	// Anonymous requests are still collapsed and cached
+	for i := 0; i < 3; i++ {
+		if res := invokeWithMetadata(context.Background(), conn, "hello"); res.err != nil {
+			t.Fatalf("unexpected error: %v", res.err)
+		}
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("expected 4 backend calls, got %d", n)
+	}
+}
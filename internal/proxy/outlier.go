@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/logger"
+	"github.com/VarunGitGood/collapser-grpc/internal/monitoring"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OutlierDetection ejects backend endpoints whose unary calls keep failing
+// or are far slower than their peers. Ejected endpoints are out of rotation
+// for BaseEjectionTime, doubled for every ejection in a row up to
+// MaxEjectionTime. It only applies to backends with more than one address.
+type OutlierDetection struct {
+	// ConsecutiveErrors server-side failures in a row eject an endpoint.
+	// Failures are the codes a 5xx maps to: Unknown, Internal, Unavailable,
+	// DataLoss and DeadlineExceeded. Zero disables the check.
+	ConsecutiveErrors int
+	// LatencyFactor ejects an endpoint whose mean latency over an Interval
+	// is more than LatencyFactor times the median of its peers'. Zero
+	// disables the check.
+	LatencyFactor float64
+
+	// Interval is how often latencies are compared and ejections expire.
+	// Zero uses 10s.
+	Interval time.Duration
+	// BaseEjectionTime is the first ejection's length, 30s when zero, and
+	// MaxEjectionTime caps it, 5m when zero.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	// MaxEjectionPercent caps the share of endpoints ejected at once, 10
+	// when zero. One endpoint may always be ejected.
+	MaxEjectionPercent int
+}
+
+func (o OutlierDetection) enabled() bool {
+	return o.ConsecutiveErrors > 0 || o.LatencyFactor > 0
+}
+
+func (o OutlierDetection) withDefaults() OutlierDetection {
+	if o.Interval <= 0 {
+		o.Interval = 10 * time.Second
+	}
+	if o.BaseEjectionTime <= 0 {
+		o.BaseEjectionTime = 30 * time.Second
+	}
+	if o.MaxEjectionTime <= 0 {
+		o.MaxEjectionTime = 5 * time.Minute
+	}
+	if o.MaxEjectionPercent <= 0 {
+		o.MaxEjectionPercent = 10
+	}
+	return o
+}
+
+// outlierMinCalls is the number of calls an endpoint must complete within an
+// Interval for its latency to be compared.
+const outlierMinCalls = 10
+
+// isServerFailure reports whether err is the gRPC equivalent of a 5xx.
+func isServerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// observe records the outcome of a unary call to e. Calls cancelled by the
+// caller say nothing about the endpoint and are ignored.
+func (b *Backend) observe(ctx context.Context, e *endpoint, latency time.Duration, err error) {
+	if !b.outlier.enabled() || ctx.Err() == context.Canceled {
+		return
+	}
+	if err == nil || !isServerFailure(err) {
+		e.failures.Store(0)
+		if err == nil {
+			e.latencyNanos.Add(int64(latency))
+			e.latencyCalls.Add(1)
+		}
+		return
+	}
+	if n := e.failures.Add(1); b.outlier.ConsecutiveErrors > 0 && n >= int64(b.outlier.ConsecutiveErrors) {
+		b.eject(e, "errors")
+	}
+}
+
+// eject takes e out of rotation unless it already is or MaxEjectionPercent
+// of the endpoints are.
+func (b *Backend) eject(e *endpoint, reason string) {
+	b.ejectMu.Lock()
+	defer b.ejectMu.Unlock()
+
+	now := time.Now()
+	if e.ejected(now) {
+		return
+	}
+	var ejected int
+	for _, other := range b.endpoints {
+		if other.ejected(now) {
+			ejected++
+		}
+	}
+	if ejected >= max(1, len(b.endpoints)*b.outlier.MaxEjectionPercent/100) {
+		logger.Debug("backend endpoint is an outlier, but too many are ejected",
+			zap.String("endpoint", e.addr),
+			zap.String("reason", reason))
+		return
+	}
+
+	duration := b.outlier.BaseEjectionTime
+	for i := e.ejections.Add(1); i > 1 && duration < b.outlier.MaxEjectionTime; i-- {
+		duration *= 2
+	}
+	duration = min(duration, b.outlier.MaxEjectionTime)
+	e.ejectedUntil.Store(now.Add(duration).UnixNano())
+	e.failures.Store(0)
+
+	monitoring.BackendEndpointEjected.WithLabelValues(e.addr).Set(1)
+	monitoring.BackendEjectionsTotal.WithLabelValues(e.addr, reason).Inc()
+	logger.Warn("backend endpoint ejected as an outlier",
+		zap.String("endpoint", e.addr),
+		zap.String("reason", reason),
+		zap.Duration("duration", duration))
+}
+
+// detectOutliers compares endpoint latencies every Interval until ctx is
+// cancelled, returning endpoints whose ejection expired to rotation.
+func (b *Backend) detectOutliers(ctx context.Context) {
+	defer b.wg.Done()
+
+	for _, e := range b.endpoints {
+		monitoring.BackendEndpointEjected.WithLabelValues(e.addr).Set(0)
+		defer monitoring.BackendEndpointEjected.DeleteLabelValues(e.addr)
+	}
+
+	ticker := time.NewTicker(b.outlier.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		b.sweepOutliers(time.Now())
+	}
+}
+
+func (b *Backend) sweepOutliers(now time.Time) {
+	type sample struct {
+		e    *endpoint
+		mean time.Duration
+	}
+	var samples []sample
+	for _, e := range b.endpoints {
+		calls, total := e.latencyCalls.Swap(0), e.latencyNanos.Swap(0)
+
+		until := e.ejectedUntil.Load()
+		switch {
+		case until != 0 && now.UnixNano() >= until:
+			e.ejectedUntil.Store(0)
+			monitoring.BackendEndpointEjected.WithLabelValues(e.addr).Set(0)
+			logger.Info("backend endpoint ejection expired, back in rotation", zap.String("endpoint", e.addr))
+		case until == 0 && e.ejections.Load() > 0:
+			// A full Interval in rotation shortens the next ejection
+			e.ejections.Add(-1)
+		}
+		if until == 0 && calls >= outlierMinCalls {
+			samples = append(samples, sample{e, time.Duration(total / calls)})
+		}
+	}
+	if b.outlier.LatencyFactor <= 0 || len(samples) < 2 {
+		return
+	}
+
+	for i, s := range samples {
+		peers := make([]time.Duration, 0, len(samples)-1)
+		for j, other := range samples {
+			if j != i {
+				peers = append(peers, other.mean)
+			}
+		}
+		slices.Sort(peers)
+		median := peers[len(peers)/2]
+		if len(peers)%2 == 0 {
+			median = (peers[len(peers)/2-1] + median) / 2
+		}
+		if float64(s.mean) > b.outlier.LatencyFactor*float64(median) {
+			b.eject(s.e, "latency")
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackend_EjectsAfterConsecutiveErrors(t *testing.T) {
+	b := testEndpoints(RoundRobin, "a", "b", "c", "d")
+	b.outlier = OutlierDetection{ConsecutiveErrors: 3, MaxEjectionPercent: 25}.withDefaults()
+	a := b.endpoints[0]
+	ctx := context.Background()
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	b.observe(ctx, a, time.Millisecond, unavailable)
+	b.observe(ctx, a, time.Millisecond, unavailable)
+	b.observe(ctx, a, time.Millisecond, status.Error(codes.NotFound, "no such item"))
+	b.observe(ctx, a, time.Millisecond, unavailable)
+	if a.ejected(time.Now()) {
+		t.Fatal("expected client errors to reset the failure count")
+	}
+	b.observe(ctx, a, time.Millisecond, unavailable)
+	b.observe(ctx, a, time.Millisecond, unavailable)
+	if !a.ejected(time.Now()) {
+		t.Fatal("expected the endpoint to be ejected after 3 failures in a row")
+	}
+	for i := 0; i < 10; i++ {
+		if b.pick(ctx) == a {
+			t.Fatal("expected the ejected endpoint to be out of rotation")
+		}
+	}
+
+	// At most 25% of the endpoints are ejected at once
+	for i := 0; i < 3; i++ {
+		b.observe(ctx, b.endpoints[1], time.Millisecond, unavailable)
+	}
+	if b.endpoints[1].ejected(time.Now()) {
+		t.Error("expected MaxEjectionPercent to keep the endpoint in rotation")
+	}
+
+	// Cancelled calls say nothing about the endpoint
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 3; i++ {
+		b.observe(cancelled, b.endpoints[2], time.Millisecond, status.FromContextError(context.Canceled).Err())
+	}
+	if n := b.endpoints[2].failures.Load(); n != 0 {
+		t.Errorf("expected cancelled calls to be ignored, got %d failures", n)
+	}
+}
+
+func TestBackend_EjectionTimeGrows(t *testing.T) {
+	b := testEndpoints(RoundRobin, "a", "b")
+	b.outlier = OutlierDetection{
+		ConsecutiveErrors: 1,
+		BaseEjectionTime:  time.Minute,
+		MaxEjectionTime:   3 * time.Minute,
+	}.withDefaults()
+	a := b.endpoints[0]
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		start := time.Now()
+		b.observe(context.Background(), a, time.Millisecond, status.Error(codes.Internal, "boom"))
+		got := time.Duration(a.ejectedUntil.Load() - start.UnixNano())
+		if got < want || got > want+time.Second {
+			t.Fatalf("expected a %v ejection, got %v", want, got)
+		}
+		// Let the ejection expire
+		b.sweepOutliers(time.Unix(0, a.ejectedUntil.Load()))
+		if a.ejected(time.Now()) {
+			t.Fatal("expected the sweep to return the endpoint to rotation")
+		}
+	}
+
+	// Intervals spent in rotation shorten the next ejection again
+	for i := 0; i < 3; i++ {
+		b.sweepOutliers(time.Now())
+	}
+	start := time.Now()
+	b.observe(context.Background(), a, time.Millisecond, status.Error(codes.Internal, "boom"))
+	if got := time.Duration(a.ejectedUntil.Load() - start.UnixNano()); got > time.Minute+time.Second {
+		t.Errorf("expected the ejection time to decay back to the base, got %v", got)
+	}
+}
+
+func TestBackend_EjectsLatencyOutliers(t *testing.T) {
+	b := testEndpoints(RoundRobin, "a", "b", "c")
+	b.outlier = OutlierDetection{LatencyFactor: 3, MaxEjectionPercent: 50}.withDefaults()
+
+	observe := func(e *endpoint, latency time.Duration, calls int) {
+		for i := 0; i < calls; i++ {
+			b.observe(context.Background(), e, latency, nil)
+		}
+	}
+	observe(b.endpoints[0], 100*time.Millisecond, outlierMinCalls)
+	observe(b.endpoints[1], 10*time.Millisecond, outlierMinCalls)
+	observe(b.endpoints[2], 20*time.Millisecond, outlierMinCalls)
+	b.sweepOutliers(time.Now())
+
+	if !b.endpoints[0].ejected(time.Now()) {
+		t.Error("expected the slow endpoint to be ejected")
+	}
+	for _, e := range b.endpoints[1:] {
+		if e.ejected(time.Now()) {
+			t.Errorf("expected %s to stay in rotation", e.addr)
+		}
+	}
+
+	// Too few calls to judge
+	observe(b.endpoints[1], time.Second, outlierMinCalls-1)
+	observe(b.endpoints[2], 10*time.Millisecond, outlierMinCalls)
+	b.sweepOutliers(time.Now())
+	if b.endpoints[1].ejected(time.Now()) {
+		t.Error("expected endpoints with few calls not to be compared")
+	}
+}
+
+func TestBackend_OutlierDetectionSkipsDownEndpoint(t *testing.T) {
+	well := startBackend(t, 0)
+	// A closed listener refuses connections, failing calls with Unavailable
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	down := lis.Addr().String()
+	lis.Close()
+
+	b, err := NewBackend([]string{down, well.addr}, BackendConfig{
+		PoolSize:         1,
+		OutlierDetection: OutlierDetection{ConsecutiveErrors: 2, MaxEjectionPercent: 50},
+	})
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+	defer b.Close()
+
+	var failed int
+	for i := 0; i < 10; i++ {
+		_, err := b.Invoke(context.Background(), testMethod, []byte("hello"))
+		if status.Code(err) == codes.Unavailable {
+			failed++
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if failed != 2 {
+		t.Errorf("expected 2 failed calls before the endpoint was ejected, got %d", failed)
+	}
+	if well.calls.Load() != 8 {
+		t.Errorf("expected the remaining calls on the healthy endpoint, got %d", well.calls.Load())
+	}
+	if !b.endpoints[0].ejected(time.Now()) {
+		t.Error("expected the down endpoint to be ejected")
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// passthroughDesc describes a stream that may carry any number of messages
+// in both directions, so it covers client-streaming and bidi methods alike.
+var passthroughDesc = &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+
+// passthrough pipes a call to the backend frame by frame without collapsing,
+// relaying the client's half-close and the backend's headers and trailers.
+func (h *Handler) passthrough(stream grpc.ServerStream, upstream *Backend, method string) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = h.mdFilter.outgoing(ctx, md)
+
+	backend, err := upstream.NewStream(ctx, passthroughDesc, method, grpc.CallContentSubtype(contentSubtype(md)))
+	if err != nil {
+		return err
+	}
+
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- pipeToBackend(stream, backend)
+	}()
+
+	backendErr := make(chan error, 1)
+	go func() {
+		backendErr <- pipeToClient(backend, stream)
+	}()
+
+	for {
+		select {
+		case err := <-clientErr:
+			if err != nil {
+				// The client went away; abort the backend call and wait for
+				// pipeToClient so nothing is sent after Handle returns
+				cancel()
+				<-backendErr
+				return err
+			}
+			// Client half-closed; keep relaying until the backend finishes
+			clientErr = nil
+		case err := <-backendErr:
+			stream.SetTrailer(responseMetadata(backend.Trailer()))
+			return err
+		}
+	}
+}
+
+// pipeToBackend forwards client messages until the client half-closes, which
+// is then relayed with CloseSend.
+func pipeToBackend(client grpc.ServerStream, backend grpc.ClientStream) error {
+	for {
+		msg := &RawMessage{}
+		if err := client.RecvMsg(msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return backend.CloseSend()
+			}
+			return err
+		}
+		if err := backend.SendMsg(msg); err != nil {
+			// The backend ended the call; its status is reported by pipeToClient
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// pipeToClient forwards backend headers and messages until the backend ends
+// the call, returning its final status.
+func pipeToClient(backend grpc.ClientStream, client grpc.ServerStream) error {
+	header, err := backend.Header()
+	if err != nil {
+		return backend.RecvMsg(&RawMessage{})
+	}
+	if err := client.SendHeader(responseMetadata(header)); err != nil {
+		return err
+	}
+
+	for {
+		msg := &RawMessage{}
+		if err := backend.RecvMsg(msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err := client.SendMsg(msg); err != nil {
+			return err
+		}
+	}
+}
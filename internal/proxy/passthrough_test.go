@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testBidiMethod = "/test.EchoService/Chat"
+
+// startBidiBackend echoes every message it receives, then reports how many
+// it saw in a trailer once the client half-closes. A client sending "fail"
+// gets an Aborted status instead.
+func startBidiBackend(t testing.TB) string {
+	t.Helper()
+	lis := listen(t)
+	s := grpc.NewServer(grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if err := stream.SendHeader(metadata.MD{"x-echo-user": md.Get("x-user")}); err != nil {
+			return err
+		}
+		count := 0
+		for {
+			in := &RawMessage{}
+			if err := stream.RecvMsg(in); err != nil {
+				if err == io.EOF {
+					stream.SetTrailer(metadata.Pairs("x-count", strconv.Itoa(count)))
+					return nil
+				}
+				return err
+			}
+			if string(in.Data) == "fail" {
+				return status.Error(codes.Aborted, "told to fail")
+			}
+			count++
+			if err := stream.SendMsg(&RawMessage{Data: append([]byte("echo:"), in.Data...)}); err != nil {
+				return err
+			}
+		}
+	}))
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+func startPassthroughProxy(t testing.TB, backendAddr string) *grpc.ClientConn {
+	t.Helper()
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: 100 * time.Millisecond,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     1 * time.Second,
+	})
+	c.Start()
+	t.Cleanup(func() { c.Stop() })
+
+	lis := listen(t)
+	serve(t, lis, c, backendAddr, WithPassthrough(testBidiMethod))
+	return dial(t, lis.Addr().String())
+}
+
+func TestHandler_PassthroughBidi(t *testing.T) {
+	conn := startPassthroughProxy(t, startBidiBackend(t))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user", "alice")
+	stream, err := conn.NewStream(ctx, passthroughDesc, testBidiMethod)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+
+	// Interleave sends and receives, as a chatty bidi client would
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := stream.SendMsg(&RawMessage{Data: []byte(msg)}); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+		var out RawMessage
+		if err := stream.RecvMsg(&out); err != nil {
+			t.Fatalf("recv failed: %v", err)
+		}
+		if got := string(out.Data); got != "echo:"+msg {
+			t.Errorf("expected echo:%s, got %s", msg, got)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("close send failed: %v", err)
+	}
+	if err := stream.RecvMsg(&RawMessage{}); err != io.EOF {
+		t.Fatalf("expected io.EOF after half-close, got %v", err)
+	}
+
+	header, _ := stream.Header()
+	if got := header.Get("x-echo-user"); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("expected x-echo-user header alice, got %v", got)
+	}
+	if got := stream.Trailer().Get("x-count"); len(got) != 1 || got[0] != "3" {
+		t.Errorf("expected x-count trailer 3, got %v", got)
+	}
+}
+
+func TestHandler_PassthroughRelaysBackendStatus(t *testing.T) {
+	conn := startPassthroughProxy(t, startBidiBackend(t))
+
+	stream, err := conn.NewStream(context.Background(), passthroughDesc, testBidiMethod)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if err := stream.SendMsg(&RawMessage{Data: []byte("fail")}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	err = stream.RecvMsg(&RawMessage{})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// forwardedHeader marks requests a replica forwarded to the key owner, so
+	// the owner executes them locally instead of forwarding again.
+	forwardedHeader = "x-collapser-forwarded"
+	// ownerHeader is sent by the owner before executing a forwarded request.
+	// Its absence on a failed call means the owner was never reached.
+	ownerHeader = "x-collapser-owner"
+)
+
+// WithPeerTLS dials peer replicas over TLS, as needed when their listeners
+// use WithServerTLS. See NewClientTLS; for mTLS listeners cfg presents the
+// replica's own certificate.
+func WithPeerTLS(cfg *tls.Config) HandlerOption {
+	return func(h *Handler) {
+		h.peerTLS = cfg
+	}
+}
+
+// peerConn returns the connection to the replica at addr, creating it on
+// first use. Connections are kept until the Handler is closed.
+func (h *Handler) peerConn(addr string) (*grpc.ClientConn, error) {
+	h.peerMu.Lock()
+	defer h.peerMu.Unlock()
+	if err := h.closing.Err(); err != nil {
+		return nil, err
+	}
+	if conn, ok := h.peerConns[addr]; ok {
+		return conn, nil
+	}
+	creds := insecure.NewCredentials()
+	if h.peerTLS != nil {
+		creds = newClientCredentials(h.peerTLS)
+	}
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodecV2(RawCodec{})))
+	if err != nil {
+		return nil, err
+	}
+	h.peerConns[addr] = conn
+	return conn, nil
+}
+
+// closePeers closes every peer connection.
+func (h *Handler) closePeers() error {
+	h.peerMu.Lock()
+	defer h.peerMu.Unlock()
+	var errs []error
+	for addr, conn := range h.peerConns {
+		errs = append(errs, conn.Close())
+		delete(h.peerConns, addr)
+	}
+	return errors.Join(errs...)
+}
+
+// forwardToPeer sends a request to the replica owning its key. Failures to
+// reach the owner are reported as collapser.ErrPeerUnavailable so the caller
+// falls back to calling the backend itself, and stale responses are marked
+// with collapser.MarkStale so they are not cached as fresh.
+func (h *Handler) forwardToPeer(ctx context.Context, addr, method string, data []byte, opts ...grpc.CallOption) ([]byte, error) {
+	conn, err := h.peerConn(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", collapser.ErrPeerUnavailable, err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardedHeader, "true")
+	var header, trailer metadata.MD
+	var out RawMessage
+	opts = append(opts, grpc.Header(&header), grpc.Trailer(&trailer))
+	err = conn.Invoke(ctx, method, &RawMessage{Data: data}, &out, opts...)
+	if err != nil {
+		if len(header.Get(ownerHeader)) == 0 {
+			return nil, fmt.Errorf("%w: %v", collapser.ErrPeerUnavailable, err)
+		}
+		return nil, err
+	}
+
+	// The stale trailer is stripped with the other reserved keys, so the
+	// collapser is told instead and sets it again for the client
+	if len(trailer.Get(StaleTrailer)) > 0 {
+		collapser.MarkStale(ctx)
+	}
+	return out.Data, nil
+}
+
+// withKeyMetadata adds the key metadata of incoming to the outgoing metadata
+// of ctx when the call goes to the owning peer. The metadata filter may drop
+// them for the backend, but the owner needs them to compute the same key.
+func (h *Handler) withKeyMetadata(ctx context.Context, incoming metadata.MD) context.Context {
+	if _, ok := collapser.PeerFromContext(ctx); !ok || len(h.keyMetadata) == 0 {
+		return ctx
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	for _, key := range h.keyMetadata {
+		if values := incoming.Get(key); len(values) > 0 {
+			md[key] = append([]string(nil), values...)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// isForwarded reports whether the request was forwarded by another replica.
+func isForwarded(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return len(md.Get(forwardedHeader)) > 0
+}
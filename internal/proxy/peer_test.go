@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestPeers_CollapseAcrossReplicas(t *testing.T) {
+	backend := startBackend(t, 100*time.Millisecond)
+
+	listeners := []net.Listener{listen(t), listen(t), listen(t)}
+	var peers []string
+	for _, lis := range listeners {
+		peers = append(peers, lis.Addr().String())
+	}
+	for i, lis := range listeners {
+		ring := collapser.NewHashRing(peers[i], peers, 50)
+		startProxy(t, lis, backend.addr, collapser.WithPeers(ring))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		conn := dial(t, peers[i%len(peers)])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := invoke(context.Background(), conn, "hello")
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if resp != "echo:hello" {
+				t.Errorf("expected 'echo:hello', got %q", resp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 backend call across all replicas, got %d", calls)
+	}
+}
+
+func TestPeers_FallbackWhenOwnerUnreachable(t *testing.T) {
+	backend := startBackend(t, 0)
+
+	// Reserve an address for a replica that never starts
+	dead := listen(t)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	lis := listen(t)
+	self := lis.Addr().String()
+	ring := collapser.NewHashRing(self, []string{self, deadAddr}, 50)
+	h := startProxy(t, lis, backend.addr, collapser.WithPeers(ring))
+
+	// Find a request owned by the unreachable replica
+	payload := ""
+	for i := 0; i < 1000; i++ {
+		candidate := fmt.Sprintf("request-%d", i)
+		if ring.Owner(h.generateKey(testMethod, []byte(candidate), nil)) == deadAddr {
+			payload = candidate
+			break
+		}
+	}
+	if payload == "" {
+		t.Fatal("no key owned by the unreachable replica")
+	}
+
+	resp, err := invoke(context.Background(), dial(t, self), payload)
+	if err != nil {
+		t.Fatalf("expected local fallback, got error: %v", err)
+	}
+	if resp != "echo:"+payload {
+		t.Errorf("expected 'echo:%s', got %q", payload, resp)
+	}
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 backend call, got %d", calls)
+	}
+}
+
+func TestPeers_KeyMetadataReachesOwner(t *testing.T) {
+	backend := startBackend(t, 0)
+
+	// The filter drops the tenant header the key is built from
+	opts := []HandlerOption{
+		WithKeyMetadata("x-tenant-id"),
+		WithMetadataFilter(MetadataFilter{Allow: []string{"x-request-id"}}),
+	}
+	ownerLis, forwarderLis := listen(t), listen(t)
+	owner, forwarder := ownerLis.Addr().String(), forwarderLis.Addr().String()
+	newCollapser := func(opts ...collapser.Option) *collapser.Collapser {
+		c := collapser.NewCollapser(collapser.Config{
+			ResultCacheDuration: time.Minute,
+			BackendTimeout:      5 * time.Second,
+			CleanupInterval:     1 * time.Second,
+		}, opts...)
+		c.Start()
+		t.Cleanup(func() { c.Stop() })
+		return c
+	}
+	serve(t, ownerLis, newCollapser(), backend.addr, opts...)
+	ring := collapser.NewHashRing(forwarder, []string{owner}, 50)
+	serve(t, forwarderLis, newCollapser(collapser.WithPeers(ring)), backend.addr, opts...)
+	conn := dial(t, forwarder)
+
+	for _, tenant := range []string{"a", "b"} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", tenant)
+		if _, err := invoke(ctx, conn, "hello"); err != nil {
+			t.Fatalf("unexpected error for tenant %s: %v", tenant, err)
+		}
+	}
+	if calls := backend.calls.Load(); calls != 2 {
+		t.Errorf("expected a backend call per tenant, got %d", calls)
+	}
+}
+
+func TestPeers_StaleIfErrorThroughOwner(t *testing.T) {
+	var failing atomic.Bool
+	var calls atomic.Int64
+	backendLis := listen(t)
+	s := grpc.NewServer(grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		in := &RawMessage{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		calls.Add(1)
+		if failing.Load() {
+			return status.Error(codes.Unavailable, "backend down")
+		}
+		return stream.SendMsg(&RawMessage{Data: append([]byte("echo:"), in.Data...)})
+	}))
+	go s.Serve(backendLis)
+	t.Cleanup(s.Stop)
+
+	newCollapser := func(staleIfError time.Duration, opts ...collapser.Option) *collapser.Collapser {
+		c := collapser.NewCollapser(collapser.Config{
+			ResultCacheDuration: 50 * time.Millisecond,
+			StaleIfError:        staleIfError,
+			BackendTimeout:      5 * time.Second,
+			CleanupInterval:     1 * time.Second,
+		}, opts...)
+		c.Start()
+		t.Cleanup(func() { c.Stop() })
+		return c
+	}
+
+	// Only the owner may serve stale data, so staleness must cross the hop
+	ownerLis, forwarderLis := listen(t), listen(t)
+	owner, forwarder := ownerLis.Addr().String(), forwarderLis.Addr().String()
+	serve(t, ownerLis, newCollapser(time.Minute), backendLis.Addr().String())
+	ring := collapser.NewHashRing(forwarder, []string{owner}, 50)
+	serve(t, forwarderLis, newCollapser(0, collapser.WithPeers(ring)), backendLis.Addr().String())
+	conn := dial(t, forwarder)
+
+	call := func() (string, metadata.MD, error) {
+		var out RawMessage
+		var trailer metadata.MD
+		err := conn.Invoke(context.Background(), testMethod, &RawMessage{Data: []byte("hello")}, &out, grpc.Trailer(&trailer))
+		return string(out.Data), trailer, err
+	}
+
+	if _, _, err := call(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	failing.Store(true)
+
+	resp, trailer, err := call()
+	if err != nil {
+		t.Fatalf("expected the owner's stale data, got error: %v", err)
+	}
+	if resp != "echo:hello" || len(trailer.Get(StaleTrailer)) == 0 {
+		t.Errorf("expected a stale 'echo:hello', got %q with trailer %v", resp, trailer)
+	}
+
+	// The forwarder did not cache the stale data as fresh
+	failing.Store(false)
+	before := calls.Load()
+	if _, trailer, err := call(); err != nil || len(trailer.Get(StaleTrailer)) > 0 {
+		t.Errorf("expected a fresh response, got trailer %v and %v", trailer, err)
+	}
+	if calls.Load() != before+1 {
+		t.Errorf("expected the recovered backend to be called, got %d calls", calls.Load()-before)
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc/codes"
+)
+
+// Mode says whether calls to a method are collapsed and cached.
+type Mode string
+
+const (
+	ModeCollapseCache Mode = "collapse+cache"
+	ModeCollapseOnly  Mode = "collapse-only"
+	ModeCacheOnly     Mode = "cache-only"
+	ModePassthrough   Mode = "passthrough"
+)
+
+// ParseMode validates a mode name.
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeCollapseCache, ModeCollapseOnly, ModeCacheOnly, ModePassthrough:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid mode %q (want collapse+cache, collapse-only, cache-only or passthrough)", s)
+}
+
+// MethodPolicy is how calls to a method are handled. Zero TTL and Timeout
+// use the collapser's configuration, as do status codes missing from
+// NegativeCache.
+type MethodPolicy struct {
+	Mode          Mode
+	TTL           time.Duration
+	Timeout       time.Duration
+	NegativeCache map[codes.Code]time.Duration
+}
+
+// collapserPolicy translates p for the collapser.
+func (p MethodPolicy) collapserPolicy() collapser.Policy {
+	return collapser.Policy{
+		NoCollapse:          p.Mode == ModeCacheOnly,
+		NoCache:             p.Mode == ModeCollapseOnly,
+		ResultCacheDuration: p.TTL,
+		BackendTimeout:      p.Timeout,
+		NegativeCachePolicy: p.NegativeCache,
+	}
+}
+
+// PolicyRule applies Policy to the methods matching Pattern, either a full
+// method name or a path.Match glob such as /shop.Catalog/Get*.
+type PolicyRule struct {
+	Pattern string
+	Policy  MethodPolicy
+}
+
+// policyTable resolves the policy of a method from the configured rules: an
+// exact rule wins, then the first matching glob, then the fallback.
+type policyTable struct {
+	exact    map[string]MethodPolicy
+	globs    []PolicyRule
+	fallback MethodPolicy
+}
+
+func newPolicyTable(rules []PolicyRule, fallback MethodPolicy) (*policyTable, error) {
+	t := &policyTable{
+		exact:    make(map[string]MethodPolicy),
+		fallback: fallback,
+	}
+	for _, rule := range rules {
+		if _, err := ParseMode(string(rule.Policy.Mode)); err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Pattern, err)
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Pattern, err)
+		}
+		if isGlob(rule.Pattern) {
+			t.globs = append(t.globs, rule)
+		} else {
+			t.exact[rule.Pattern] = rule.Policy
+		}
+	}
+	if _, err := ParseMode(string(fallback.Mode)); err != nil {
+		return nil, fmt.Errorf("default policy: %w", err)
+	}
+	return t, nil
+}
+
+func (t *policyTable) lookup(method string) MethodPolicy {
+	if p, ok := t.rule(method); ok {
+		return p
+	}
+	return t.fallback
+}
+
+// rule returns the policy of the rule matching method, if any.
+func (t *policyTable) rule(method string) (MethodPolicy, bool) {
+	rule, ok := t.match(method)
+	return rule.Policy, ok
+}
+
+// match returns the rule matching method, if any.
+func (t *policyTable) match(method string) (PolicyRule, bool) {
+	if p, ok := t.exact[method]; ok {
+		return PolicyRule{Pattern: method, Policy: p}, true
+	}
+	for _, rule := range t.globs {
+		if ok, _ := path.Match(rule.Pattern, method); ok {
+			return rule, true
+		}
+	}
+	return PolicyRule{}, false
+}
+
+// policy resolves the policy of method. Configured rules win. Otherwise a
+// described method is passed through unless its idempotency_level is
+// NO_SIDE_EFFECTS or IDEMPOTENT. Other methods take the mode of their
+// cluster's policy when it sets one, then their (collapser.policy) option,
+// collapse+cache if described, or the fallback. A cluster's TTL and Timeout
+// override those of whichever applies.
+func (h *Handler) policy(method string) MethodPolicy {
+	if p, ok := h.policies.rule(method); ok {
+		return p
+	}
+	a, described := h.descriptors.Load().annotation(method)
+	if described && !a.idempotent {
+		return MethodPolicy{Mode: ModePassthrough}
+	}
+	var clusterPolicy *MethodPolicy
+	if c, ok := h.routes.lookup(method); ok {
+		clusterPolicy = c.policy
+	}
+
+	var p MethodPolicy
+	switch {
+	case clusterPolicy != nil && clusterPolicy.Mode != "":
+		return *clusterPolicy
+	case !described:
+		p = h.policies.fallback
+	case a.policy != nil:
+		p = *a.policy
+	default:
+		p = MethodPolicy{Mode: ModeCollapseCache}
+	}
+	if clusterPolicy != nil {
+		if clusterPolicy.TTL > 0 {
+			p.TTL = clusterPolicy.TTL
+		}
+		if clusterPolicy.Timeout > 0 {
+			p.Timeout = clusterPolicy.Timeout
+		}
+	}
+	return p
+}
+
+func isGlob(pattern string) bool {
+	for _, c := range pattern {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPolicyTable_Lookup(t *testing.T) {
+	table, err := newPolicyTable([]PolicyRule{
+		{Pattern: "/shop.Catalog/Get*", Policy: MethodPolicy{Mode: ModeCollapseOnly}},
+		{Pattern: "/shop.Catalog/GetProduct", Policy: MethodPolicy{Mode: ModeCollapseCache, TTL: time.Second}},
+		{Pattern: "/shop.*/*", Policy: MethodPolicy{Mode: ModeCacheOnly}},
+	}, MethodPolicy{Mode: ModePassthrough})
+	if err != nil {
+		t.Fatalf("failed to build policy table: %v", err)
+	}
+
+	for method, want := range map[string]Mode{
+		"/shop.Catalog/GetProduct":  ModeCollapseCache,
+		"/shop.Catalog/GetCategory": ModeCollapseOnly,
+		"/shop.Catalog/Search":      ModeCacheOnly,
+		"/shop.Orders/CreateOrder":  ModeCacheOnly,
+		"/other.Service/Method":     ModePassthrough,
+	} {
+		if got := table.lookup(method).Mode; got != want {
+			t.Errorf("%s: expected %s, got %s", method, want, got)
+		}
+	}
+	if ttl := table.lookup("/shop.Catalog/GetProduct").TTL; ttl != time.Second {
+		t.Errorf("expected exact rule TTL of 1s, got %v", ttl)
+	}
+
+	if _, err := newPolicyTable([]PolicyRule{{Pattern: "/a/b", Policy: MethodPolicy{Mode: "collapse"}}}, MethodPolicy{Mode: ModePassthrough}); err == nil {
+		t.Error("expected an error for an invalid mode")
+	}
+}
+
+func TestHandler_Policies(t *testing.T) {
+	backend := startBackend(t, 20*time.Millisecond)
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: time.Minute,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     time.Second,
+	})
+	lis := listen(t)
+	serve(t, lis, c, backend.addr, WithPolicies([]PolicyRule{
+		{Pattern: testMethod, Policy: MethodPolicy{Mode: ModeCollapseCache}},
+	}, MethodPolicy{Mode: ModePassthrough}))
+	conn := dial(t, lis.Addr().String())
+
+	call := func(ctx context.Context, method, data string) {
+		t.Helper()
+		var out RawMessage
+		if err := conn.Invoke(ctx, method, &RawMessage{Data: []byte(data)}, &out); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		call(context.Background(), testMethod, "hello")
+	}
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 backend call for the cached method, got %d", calls)
+	}
+
+	// Methods without a rule are passed straight through
+	for i := 0; i < 3; i++ {
+		call(context.Background(), "/test.EchoService/CreateOrder", "hello")
+	}
+	if calls := backend.calls.Load(); calls != 4 {
+		t.Errorf("expected 3 more backend calls for the passthrough method, got %d", calls-1)
+	}
+}
+
+func TestHandler_PassthroughBoundedByBackendTimeout(t *testing.T) {
+	backend := startBackend(t, 2*time.Second)
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 100 * time.Millisecond, CleanupInterval: time.Second})
+	lis := listen(t)
+	serve(t, lis, c, backend.addr, WithPolicies(nil, MethodPolicy{Mode: ModePassthrough}))
+	conn := dial(t, lis.Addr().String())
+
+	start := time.Now()
+	if _, err := invoke(context.Background(), conn, "hello"); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded from a stuck backend, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the call to end at the backend timeout, took %v", elapsed)
+	}
+}
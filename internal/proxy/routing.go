@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DefaultCluster names the cluster NewHandler creates for its backendAddr.
+const DefaultCluster = "default"
+
+// Cluster is a named group of backend addresses serving the methods routed
+// to it.
+type Cluster struct {
+	Name      string
+	Addresses []string
+	Backend   BackendConfig
+
+	// Policy, when set, applies to the cluster's methods that match no
+	// policy rule and are not marked as having side effects. Its Mode, if
+	// set, takes precedence over (collapser.policy) options and the
+	// fallback policy; otherwise only its TTL and Timeout apply on top.
+	Policy *MethodPolicy
+}
+
+// Route sends the methods matching Pattern to the named cluster. Pattern is
+// a full method name or glob (/pkg.Service/Get*), or a service name or glob
+// (pkg.Service, pkg.*) matching every method of the service.
+type Route struct {
+	Pattern string
+	Cluster string
+}
+
+// WithRoutes fronts several backend clusters. Methods matching no route go
+// to defaultCluster or, when it is empty, to the DefaultCluster serving
+// backendAddr. Without either they fail with Unimplemented.
+func WithRoutes(clusters []Cluster, routes []Route, defaultCluster string) HandlerOption {
+	return func(h *Handler) {
+		h.clusterCfgs = clusters
+		h.routeCfgs = routes
+		h.defaultCluster = defaultCluster
+	}
+}
+
+// cluster is a Cluster with its connections.
+type cluster struct {
+	name    string
+	backend *Backend
+	policy  *MethodPolicy
+}
+
+// routeTable resolves the cluster of a method: an exact method route wins,
+// then the first matching method glob or service pattern, then the fallback.
+type routeTable struct {
+	exact    map[string]*cluster
+	routes   []route
+	fallback *cluster
+}
+
+type route struct {
+	pattern string
+	service bool
+	cluster *cluster
+}
+
+func newRouteTable(clusters map[string]*cluster, routes []Route, fallback string) (*routeTable, error) {
+	t := &routeTable{exact: make(map[string]*cluster)}
+	if fallback != "" {
+		if t.fallback = clusters[fallback]; t.fallback == nil {
+			return nil, fmt.Errorf("default cluster %q is not defined", fallback)
+		}
+	}
+	for _, r := range routes {
+		c := clusters[r.Cluster]
+		if c == nil {
+			return nil, fmt.Errorf("route %s: cluster %q is not defined", r.Pattern, r.Cluster)
+		}
+		if r.Pattern == "" {
+			return nil, errors.New("route with an empty pattern")
+		}
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("route %s: %w", r.Pattern, err)
+		}
+		service := !strings.HasPrefix(r.Pattern, "/")
+		if !service && !isGlob(r.Pattern) {
+			t.exact[r.Pattern] = c
+			continue
+		}
+		t.routes = append(t.routes, route{pattern: r.Pattern, service: service, cluster: c})
+	}
+	return t, nil
+}
+
+func (t *routeTable) lookup(method string) (*cluster, bool) {
+	if c, ok := t.exact[method]; ok {
+		return c, true
+	}
+	service, _, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	for _, r := range t.routes {
+		name := method
+		if r.service {
+			name = service
+		}
+		if ok, _ := path.Match(r.pattern, name); ok {
+			return r.cluster, true
+		}
+	}
+	return t.fallback, t.fallback != nil
+}
+
+// newClusters connects to every cluster, adding the DefaultCluster for
+// backendAddr when it is set, and builds the route table.
+func (h *Handler) newClusters(backendAddr string) error {
+	cfgs := h.clusterCfgs
+	fallback := h.defaultCluster
+	if backendAddr != "" {
+		cfgs = append([]Cluster{{Name: DefaultCluster, Addresses: []string{backendAddr}, Backend: h.backendCfg}}, cfgs...)
+		if fallback == "" {
+			fallback = DefaultCluster
+		}
+	}
+	if len(cfgs) == 0 {
+		return errors.New("no backend address or clusters configured")
+	}
+
+	clusters := make(map[string]*cluster, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return errors.New("cluster without a name")
+		}
+		if clusters[cfg.Name] != nil {
+			return fmt.Errorf("cluster %q is defined twice", cfg.Name)
+		}
+		if cfg.Policy != nil && cfg.Policy.Mode != "" {
+			if _, err := ParseMode(string(cfg.Policy.Mode)); err != nil {
+				return fmt.Errorf("cluster %s: %w", cfg.Name, err)
+			}
+		}
+		backend, err := NewBackend(cfg.Addresses, cfg.Backend)
+		if err != nil {
+			return fmt.Errorf("cluster %s: %w", cfg.Name, err)
+		}
+		c := &cluster{name: cfg.Name, backend: backend, policy: cfg.Policy}
+		clusters[cfg.Name] = c
+		h.clusters = append(h.clusters, c)
+	}
+
+	routes, err := newRouteTable(clusters, h.routeCfgs, fallback)
+	if err != nil {
+		return err
+	}
+	h.routes = routes
+	return nil
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestRouteTable_Lookup(t *testing.T) {
+	clusters := map[string]*cluster{"a": {name: "a"}, "b": {name: "b"}, "c": {name: "c"}}
+	table, err := newRouteTable(clusters, []Route{
+		{Pattern: "/shop.Catalog/Get*", Cluster: "b"},
+		{Pattern: "/shop.Catalog/GetProduct", Cluster: "c"},
+		{Pattern: "shop.Catalog", Cluster: "a"},
+		{Pattern: "shop.*", Cluster: "c"},
+	}, "")
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	for method, want := range map[string]string{
+		"/shop.Catalog/GetProduct":  "c",
+		"/shop.Catalog/GetCategory": "b",
+		"/shop.Catalog/Search":      "a",
+		"/shop.Orders/CreateOrder":  "c",
+	} {
+		if c, ok := table.lookup(method); !ok || c.name != want {
+			t.Errorf("%s: expected cluster %s, got %v", method, want, c)
+		}
+	}
+	if _, ok := table.lookup("/other.Service/Method"); ok {
+		t.Error("expected no cluster for an unrouted method without a default")
+	}
+
+	table, err = newRouteTable(clusters, nil, "b")
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+	if c, ok := table.lookup("/other.Service/Method"); !ok || c.name != "b" {
+		t.Errorf("expected the default cluster, got %v", c)
+	}
+
+	for name, routes := range map[string][]Route{
+		"undefined cluster": {{Pattern: "shop.Catalog", Cluster: "missing"}},
+		"bad pattern":       {{Pattern: "/shop.Catalog/[", Cluster: "a"}},
+		"empty pattern":     {{Pattern: "", Cluster: "a"}},
+	} {
+		if _, err := newRouteTable(clusters, routes, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := newRouteTable(clusters, nil, "missing"); err == nil {
+		t.Error("expected an error for an undefined default cluster")
+	}
+}
+
+func TestHandler_RoutesToClusters(t *testing.T) {
+	catalog := startBackend(t, 0)
+	orders := startBackend(t, 0)
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: time.Minute,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     time.Second,
+	})
+	lis := listen(t)
+	serve(t, lis, c, "", WithRoutes([]Cluster{
+		{Name: "catalog", Addresses: []string{catalog.addr}},
+		{Name: "orders", Addresses: []string{orders.addr}, Policy: &MethodPolicy{Mode: ModePassthrough}},
+	}, []Route{
+		{Pattern: "test.EchoService", Cluster: "catalog"},
+		{Pattern: "/test.Orders/*", Cluster: "orders"},
+	}, ""))
+	conn := dial(t, lis.Addr().String())
+
+	call := func(method string) error {
+		var out RawMessage
+		return conn.Invoke(context.Background(), method, &RawMessage{Data: []byte("hello")}, &out)
+	}
+	for i := 0; i < 3; i++ {
+		if err := call(testMethod); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := call("/test.Orders/Create"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls := catalog.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 collapsed call to the catalog cluster, got %d", calls)
+	}
+	if calls := orders.calls.Load(); calls != 3 {
+		t.Errorf("expected 3 calls to the passthrough orders cluster, got %d", calls)
+	}
+
+	if err := call("/test.Unknown/Method"); status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected Unimplemented for an unrouted method, got %v", err)
+	}
+}
+
+func TestHandler_DefaultCluster(t *testing.T) {
+	primary := startBackend(t, 0)
+	other := startBackend(t, 0)
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	lis := listen(t)
+	serve(t, lis, c, primary.addr, WithRoutes([]Cluster{
+		{Name: "other", Addresses: []string{other.addr}},
+	}, []Route{{Pattern: "test.Other", Cluster: "other"}}, ""))
+	conn := dial(t, lis.Addr().String())
+
+	if _, err := invoke(context.Background(), conn, "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := primary.calls.Load(); calls != 1 {
+		t.Errorf("expected unrouted methods to reach the backend address, got %d calls", calls)
+	}
+	if other.calls.Load() != 0 {
+		t.Error("expected no calls to the routed cluster")
+	}
+}
+
+func TestHandler_SpreadsCallsOverClusterAddresses(t *testing.T) {
+	first := startBackend(t, 0)
+	second := startBackend(t, 0)
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	lis := listen(t)
+	serve(t, lis, c, "", WithRoutes([]Cluster{{
+		Name:      "echo",
+		Addresses: []string{first.addr, second.addr},
+		Backend:   BackendConfig{PoolSize: 1},
+	}}, nil, "echo"))
+	conn := dial(t, lis.Addr().String())
+
+	for i := 0; i < 10; i++ {
+		if _, err := invoke(context.Background(), conn, string(rune('a'+i))); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if first.calls.Load() != 5 || second.calls.Load() != 5 {
+		t.Errorf("expected 5 calls to each address, got %d and %d", first.calls.Load(), second.calls.Load())
+	}
+}
+
+func TestNewHandler_RejectsInvalidClusters(t *testing.T) {
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	for name, tc := range map[string]struct {
+		addr string
+		opt  HandlerOption
+	}{
+		"no backend":       {"", WithRoutes(nil, nil, "")},
+		"no addresses":     {"", WithRoutes([]Cluster{{Name: "a"}}, nil, "a")},
+		"duplicate name":   {"127.0.0.1:1", WithRoutes([]Cluster{{Name: DefaultCluster, Addresses: []string{"127.0.0.1:1"}}}, nil, "")},
+		"invalid policy":   {"", WithRoutes([]Cluster{{Name: "a", Addresses: []string{"127.0.0.1:1"}, Policy: &MethodPolicy{Mode: "collapse"}}}, nil, "a")},
+		"undefined target": {"127.0.0.1:1", WithRoutes(nil, []Route{{Pattern: "pkg.Service", Cluster: "missing"}}, "")},
+	} {
+		if _, err := NewHandler(c, tc.addr, tc.opt); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestHandler_MergesReflectedDescriptors(t *testing.T) {
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	h := serve(t, listen(t), c, "127.0.0.1:1")
+
+	// A service of another cluster built on the same messages
+	other := echoFile()
+	other.Name = proto.String("other/other.proto")
+	other.Package = proto.String("other")
+	other.Dependency = []string{"test/echo.proto"}
+	other.MessageType = nil
+	if err := h.addReflected([]*descriptorpb.FileDescriptorProto{echoFile()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A second cluster reporting a file already loaded along with its own
+	if err := h.addReflected([]*descriptorpb.FileDescriptorProto{echoFile(), other}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, method := range []string{testMethod, "/other.EchoService/Echo"} {
+		if _, ok := h.descriptors.Load().Method(method); !ok {
+			t.Errorf("expected %s to be described", method)
+		}
+	}
+}
+
+func TestHandler_ClusterPolicyKeepsSideEffectsUncollapsed(t *testing.T) {
+	// Echo is described without an idempotency_level, so it may mutate
+	d, err := annotatedDescriptors(descriptorpb.MethodOptions_IDEMPOTENCY_UNKNOWN, nil)
+	if err != nil {
+		t.Fatalf("failed to build descriptors: %v", err)
+	}
+	backend := startBackend(t, 0)
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: time.Minute,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     time.Second,
+	})
+	lis := listen(t)
+	h := serve(t, lis, c, "", WithDescriptors(d), WithPolicies(nil, MethodPolicy{Mode: ModePassthrough}), WithRoutes([]Cluster{
+		{Name: "orders", Addresses: []string{backend.addr}, Policy: &MethodPolicy{TTL: time.Minute, Timeout: time.Second}},
+		{Name: "cached", Addresses: []string{backend.addr}, Policy: &MethodPolicy{Mode: ModeCollapseCache}},
+	}, []Route{{Pattern: "test.Other", Cluster: "cached"}}, "orders"))
+	conn := dial(t, lis.Addr().String())
+
+	for i := 0; i < 3; i++ {
+		if _, err := invoke(context.Background(), conn, "create"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls := backend.calls.Load(); calls != 3 {
+		t.Errorf("expected every call of the mutating method to reach the backend, got %d", calls)
+	}
+
+	for method, want := range map[string]MethodPolicy{
+		// A cluster ttl leaves modes alone, but applies to what is cached
+		testMethod:                {Mode: ModePassthrough},
+		"/test.EchoService/Watch": {Mode: ModeCollapseCache, TTL: time.Minute, Timeout: time.Second},
+		"/test.Unknown/Method":    {Mode: ModePassthrough, TTL: time.Minute, Timeout: time.Second},
+		// A cluster mode applies to undescribed methods
+		"/test.Other/Method": {Mode: ModeCollapseCache},
+	} {
+		got := h.policy(method)
+		if got.Mode != want.Mode || got.TTL != want.TTL || got.Timeout != want.Timeout {
+			t.Errorf("%s: expected %+v, got %+v", method, want, got)
+		}
+	}
+}
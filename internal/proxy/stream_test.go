@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const testStreamMethod = "/test.EchoService/Watch"
+
+// startStreamingBackend serves a stream of count echoed messages per call,
+// pausing between them, with a header and trailer, and counts the calls it
+// receives.
+func startStreamingBackend(t testing.TB, count int, interval time.Duration) (string, *atomic.Int64) {
+	t.Helper()
+	lis := listen(t)
+	var calls atomic.Int64
+	s := grpc.NewServer(grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		in := &RawMessage{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		calls.Add(1)
+		stream.SetHeader(metadata.Pairs("x-watch", string(in.Data)))
+		stream.SetTrailer(metadata.Pairs("x-watch-count", fmt.Sprint(count)))
+		for i := 0; i < count; i++ {
+			time.Sleep(interval)
+			msg := fmt.Sprintf("%s:%d", in.Data, i)
+			if err := stream.SendMsg(&RawMessage{Data: []byte(msg)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String(), &calls
+}
+
+func watch(ctx context.Context, conn *grpc.ClientConn, data string, opts ...grpc.CallOption) ([]string, error) {
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, testStreamMethod, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&RawMessage{Data: []byte(data)}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	var msgs []string
+	for {
+		var out RawMessage
+		if err := stream.RecvMsg(&out); err != nil {
+			if err == io.EOF {
+				return msgs, nil
+			}
+			return msgs, err
+		}
+		msgs = append(msgs, string(out.Data))
+	}
+}
+
+func TestHandler_CollapsesServerStreams(t *testing.T) {
+	backendAddr, calls := startStreamingBackend(t, 5, 20*time.Millisecond)
+
+	c := collapser.NewCollapser(collapser.Config{
+		ResultCacheDuration: 100 * time.Millisecond,
+		BackendTimeout:      5 * time.Second,
+		CleanupInterval:     1 * time.Second,
+	})
+	streams := collapser.NewStreamGroup(collapser.StreamConfig{MaxReplayMessages: 10})
+	lis := listen(t)
+	serve(t, lis, c, backendAddr, WithServerStreaming(streams, testStreamMethod))
+	conn := dial(t, lis.Addr().String())
+
+	type result struct {
+		msgs []string
+		err  error
+	}
+	results := make(chan result, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			// Stagger callers so later ones rely on the replay buffer
+			time.Sleep(time.Duration(i) * 10 * time.Millisecond)
+			msgs, err := watch(context.Background(), conn, "hello")
+			results <- result{msgs, err}
+		}()
+	}
+
+	want := "[hello:0 hello:1 hello:2 hello:3 hello:4]"
+	for i := 0; i < 5; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("unexpected error: %v", r.err)
+		}
+		if got := fmt.Sprint(r.msgs); got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 backend stream, got %d", n)
+	}
+}
+
+func TestHandler_RelaysServerStreamMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []HandlerOption
+	}{
+		{"Collapsed", nil},
+		{"Passthrough", []HandlerOption{WithPolicies(nil, MethodPolicy{Mode: ModePassthrough})}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backendAddr, _ := startStreamingBackend(t, 3, 20*time.Millisecond)
+
+			c := collapser.NewCollapser(collapser.Config{
+				ResultCacheDuration: 100 * time.Millisecond,
+				BackendTimeout:      5 * time.Second,
+				CleanupInterval:     1 * time.Second,
+			})
+			streams := collapser.NewStreamGroup(collapser.StreamConfig{MaxReplayMessages: 10})
+			lis := listen(t)
+			opts := append([]HandlerOption{WithServerStreaming(streams, testStreamMethod)}, tc.opts...)
+			serve(t, lis, c, backendAddr, opts...)
+			conn := dial(t, lis.Addr().String())
+
+			type result struct {
+				header, trailer metadata.MD
+				err             error
+			}
+			results := make(chan result, 3)
+			for i := 0; i < 3; i++ {
+				go func() {
+					// Later callers join after the first message was replayed
+					time.Sleep(time.Duration(i) * 30 * time.Millisecond)
+					var r result
+					_, r.err = watch(context.Background(), conn, "hello", grpc.Header(&r.header), grpc.Trailer(&r.trailer))
+					results <- r
+				}()
+			}
+
+			for i := 0; i < 3; i++ {
+				r := <-results
+				if r.err != nil {
+					t.Fatalf("unexpected error: %v", r.err)
+				}
+				if got := r.header.Get("x-watch"); len(got) != 1 || got[0] != "hello" {
+					t.Errorf("expected the backend header, got %v", r.header)
+				}
+				if got := r.trailer.Get("x-watch-count"); len(got) != 1 || got[0] != "3" {
+					t.Errorf("expected the backend trailer, got %v", r.trailer)
+				}
+			}
+		})
+	}
+}
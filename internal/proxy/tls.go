@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/logger"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSFiles names the PEM files for one side of a TLS connection. CertFile and
+// KeyFile hold this side's certificate; CAFile holds the CAs used to verify
+// the other side.
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// reloadCheckInterval is how often, at most, the files are checked for
+// changes during handshakes.
+var reloadCheckInterval = time.Second
+
+// certFiles keeps the parsed contents of TLSFiles, reloading them when the
+// files change on disk so certificates can be rotated without a restart.
+type certFiles struct {
+	files TLSFiles
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+func newCertFiles(files TLSFiles) (*certFiles, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("TLS certificate and key files must be set together")
+	}
+	c := &certFiles{files: files}
+	modTimes, err := c.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTimes); err != nil {
+		return nil, err
+	}
+	c.checked = time.Now()
+	return c, nil
+}
+
+// current returns the certificate and CA pool, reloading them first if the
+// files changed. A failed reload keeps serving the previous contents.
+func (c *certFiles) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= reloadCheckInterval {
+		c.checked = time.Now()
+		modTimes, err := c.stat()
+		if err == nil && modTimes != c.modTimes {
+			err = c.load(modTimes)
+			if err == nil {
+				logger.Info("reloaded TLS files", zap.String("cert", c.files.CertFile), zap.String("ca", c.files.CAFile))
+			}
+		}
+		if err != nil {
+			logger.Error("failed to reload TLS files", zap.Error(err))
+		}
+	}
+	return c.cert, c.pool
+}
+
+func (c *certFiles) stat() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, path := range []string{c.files.CertFile, c.files.KeyFile, c.files.CAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (c *certFiles) load(modTimes [3]time.Time) error {
+	var cert *tls.Certificate
+	if c.files.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(c.files.CertFile, c.files.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+
+	var pool *x509.CertPool
+	if c.files.CAFile != "" {
+		pem, err := os.ReadFile(c.files.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.files.CAFile)
+		}
+	}
+
+	c.cert, c.pool, c.modTimes = cert, pool, modTimes
+	return nil
+}
+
+// NewServerTLS returns a TLS config for the proxy listener. When CAFile is
+// set, clients must present a certificate signed by one of its CAs (mTLS).
+func NewServerTLS(files TLSFiles) (*tls.Config, error) {
+	if files.CertFile == "" {
+		return nil, errors.New("TLS certificate file is required")
+	}
+	c, err := newCertFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.current()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   []string{"h2"},
+			}
+			if pool != nil {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				cfg.ClientCAs = pool
+			}
+			return cfg, nil
+		},
+	}, nil
+}
+
+// NewClientTLS returns a TLS config for connections to the backend. The
+// server is verified against CAFile, or the system roots when it is unset,
+// and CertFile is presented when the server asks for a client certificate.
+// serverName overrides the name used for SNI and verification; without it
+// the server is verified against the address it was dialed by. Used with
+// credentials.NewTLS rather than through the proxy, servers dialed by IP
+// need serverName.
+func NewClientTLS(files TLSFiles, serverName string) (*tls.Config, error) {
+	c, err := newCertFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert, _ := c.current(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+		// The default verification would pin the CA pool loaded at startup,
+		// so the server is verified in VerifyConnection instead.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("backend presented no certificate")
+			}
+			if cs.ServerName == "" {
+				// Go leaves the name empty for IP addresses, which would
+				// accept a certificate for any name
+				return errors.New("no server name to verify the backend certificate against")
+			}
+			_, pool := c.current()
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         pool,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}, nil
+}
+
+// clientCredentials dials with cfg, verifying configs from NewClientTLS
+// against the address the server was dialed by. VerifyConnection only sees
+// the SNI name, which Go does not send for IP addresses.
+type clientCredentials struct {
+	credentials.TransportCredentials
+	config *tls.Config
+}
+
+func newClientCredentials(cfg *tls.Config) credentials.TransportCredentials {
+	return &clientCredentials{TransportCredentials: credentials.NewTLS(cfg), config: cfg}
+}
+
+func (c *clientCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	verify := c.config.VerifyConnection
+	if verify == nil {
+		return c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	}
+	cfg := c.config.Clone()
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(authority)
+		if err != nil {
+			host = authority
+		}
+		cfg.ServerName = host
+	}
+	name := cfg.ServerName
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		cs.ServerName = name
+		return verify(cs)
+	}
+	return credentials.NewTLS(cfg).ClientHandshake(ctx, authority, rawConn)
+}
+
+func (c *clientCredentials) Clone() credentials.TransportCredentials {
+	return newClientCredentials(c.config.Clone())
+}
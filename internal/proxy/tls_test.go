@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VarunGitGood/collapser-grpc/internal/collapser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t testing.TB) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for name signed by the CA, and its key, to dir.
+// Names that are IP addresses are issued as IP SANs.
+func (ca *testCA) issue(t testing.TB, dir, name string, serial int64) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+func writeFile(t testing.TB, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestTLS_MutualTLSEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	backendCert, backendKey := ca.issue(t, dir, "backend.internal", 2)
+	proxyCert, proxyKey := ca.issue(t, dir, "proxy.internal", 3)
+	clientCert, clientKey := ca.issue(t, dir, "client.internal", 4)
+
+	// Backend requiring client certificates from the proxy
+	backendTLS, err := NewServerTLS(TLSFiles{CertFile: backendCert, KeyFile: backendKey, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("failed to load backend TLS: %v", err)
+	}
+	backendLis := listen(t)
+	backend := grpc.NewServer(grpc.Creds(credentials.NewTLS(backendTLS)), grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(echoHandler))
+	go backend.Serve(backendLis)
+	t.Cleanup(backend.Stop)
+
+	// Proxy dialing the backend by IP, whose certificate only names
+	// backend.internal, so verification needs the override
+	clientTLS, err := NewClientTLS(TLSFiles{CertFile: proxyCert, KeyFile: proxyKey, CAFile: caFile}, "backend.internal")
+	if err != nil {
+		t.Fatalf("failed to load backend client TLS: %v", err)
+	}
+	serverTLS, err := NewServerTLS(TLSFiles{CertFile: proxyCert, KeyFile: proxyKey, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("failed to load proxy TLS: %v", err)
+	}
+	c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+	lis := listen(t)
+	serve(t, lis, c, backendLis.Addr().String(),
+		WithBackendConfig(BackendConfig{TLS: clientTLS}),
+		WithServerTLS(serverTLS))
+
+	userTLS, err := NewClientTLS(TLSFiles{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile}, "proxy.internal")
+	if err != nil {
+		t.Fatalf("failed to load client TLS: %v", err)
+	}
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(userTLS)), rawCallCodec)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := invoke(ctx, conn, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != "echo:hello" {
+		t.Errorf("expected echo:hello, got %q", resp)
+	}
+
+	// Clients without a certificate are refused by the mTLS listener
+	anonTLS, _ := NewClientTLS(TLSFiles{CAFile: caFile}, "proxy.internal")
+	anon, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(anonTLS)), rawCallCodec)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { anon.Close() })
+	if _, err := invoke(ctx, anon, "hello"); err == nil {
+		t.Error("expected call without client certificate to fail")
+	}
+}
+
+func TestTLS_VerifiesBackendDialedByIP(t *testing.T) {
+	for _, tc := range []struct {
+		name, certName string
+		ok             bool
+	}{
+		{"MatchingIP", "127.0.0.1", true},
+		{"WrongName", "evil.example", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ca := newTestCA(t)
+			caFile := filepath.Join(dir, "ca.crt")
+			writeFile(t, caFile, ca.pem)
+			certFile, keyFile := ca.issue(t, dir, tc.certName, 2)
+
+			backendTLS, err := NewServerTLS(TLSFiles{CertFile: certFile, KeyFile: keyFile})
+			if err != nil {
+				t.Fatalf("failed to load backend TLS: %v", err)
+			}
+			backendLis := listen(t)
+			backend := grpc.NewServer(grpc.Creds(credentials.NewTLS(backendTLS)), grpc.ForceServerCodecV2(RawCodec{}), grpc.UnknownServiceHandler(echoHandler))
+			go backend.Serve(backendLis)
+			t.Cleanup(backend.Stop)
+
+			// No override, so the certificate must match 127.0.0.1
+			clientTLS, err := NewClientTLS(TLSFiles{CAFile: caFile}, "")
+			if err != nil {
+				t.Fatalf("failed to load backend client TLS: %v", err)
+			}
+			c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second})
+			lis := listen(t)
+			serve(t, lis, c, backendLis.Addr().String(), WithBackendConfig(BackendConfig{TLS: clientTLS}))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err = invoke(ctx, dial(t, lis.Addr().String()), "hello")
+			if tc.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("expected a certificate for the wrong name to be rejected")
+			}
+		})
+	}
+}
+
+func TestTLS_ReloadsRotatedCertificate(t *testing.T) {
+	defer func(d time.Duration) { reloadCheckInterval = d }(reloadCheckInterval)
+	reloadCheckInterval = 0
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "proxy.internal", 10)
+
+	serverTLS, err := NewServerTLS(TLSFiles{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("failed to load TLS: %v", err)
+	}
+	lis := tls.NewListener(listen(t), serverTLS)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	servedSerial := func() int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		if err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if serial := servedSerial(); serial != 10 {
+		t.Fatalf("expected serial 10, got %d", serial)
+	}
+
+	// Rotate the files in place, making sure the modification time changes
+	ca.issue(t, dir, "proxy.internal", 11)
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatalf("failed to touch %s: %v", path, err)
+		}
+	}
+
+	if serial := servedSerial(); serial != 11 {
+		t.Errorf("expected rotated serial 11, got %d", serial)
+	}
+}
+
+func TestTLS_PeersForwardOverMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	proxyCert, proxyKey := ca.issue(t, dir, "proxy.internal", 2)
+	clientCert, clientKey := ca.issue(t, dir, "client.internal", 3)
+
+	serverTLS, err := NewServerTLS(TLSFiles{CertFile: proxyCert, KeyFile: proxyKey, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("failed to load proxy TLS: %v", err)
+	}
+	peerTLS, err := NewClientTLS(TLSFiles{CertFile: proxyCert, KeyFile: proxyKey, CAFile: caFile}, "proxy.internal")
+	if err != nil {
+		t.Fatalf("failed to load peer TLS: %v", err)
+	}
+
+	backend := startBackend(t, 100*time.Millisecond)
+	listeners := []net.Listener{listen(t), listen(t)}
+	peers := []string{listeners[0].Addr().String(), listeners[1].Addr().String()}
+	for i, lis := range listeners {
+		c := collapser.NewCollapser(collapser.Config{BackendTimeout: 5 * time.Second, CleanupInterval: time.Second},
+			collapser.WithPeers(collapser.NewHashRing(peers[i], peers, 50)))
+		serve(t, lis, c, backend.addr, WithServerTLS(serverTLS), WithPeerTLS(peerTLS))
+	}
+
+	userTLS, err := NewClientTLS(TLSFiles{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile}, "proxy.internal")
+	if err != nil {
+		t.Fatalf("failed to load client TLS: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		conn, err := grpc.NewClient(peers[i%len(peers)], grpc.WithTransportCredentials(credentials.NewTLS(userTLS)), rawCallCodec)
+		if err != nil {
+			t.Fatalf("failed to dial proxy: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := invoke(context.Background(), conn, "hello"); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("expected the replicas to collapse over TLS into 1 backend call, got %d", calls)
+	}
+}